@@ -0,0 +1,290 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/micro/website/model/store"
+)
+
+// aggregation accumulates a numeric field over a result set.
+type aggregation struct {
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// toFloat64 reads a numeric field value in any of the shapes a decode can
+// produce it in.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// aggregateField streams the records matching the query and accumulates the
+// named numeric field. Only the one field is pulled out of each record.
+func (d *db) aggregateField(query Query, field string) (*aggregation, error) {
+	agg := &aggregation{}
+	err := d.ListEach(query, func(raw []byte) error {
+		m := map[string]interface{}{}
+		if err := d.decode(raw, &m); err != nil {
+			return err
+		}
+		value, err := resolveFieldValue(m, field)
+		if err != nil {
+			return err
+		}
+		f, ok := toFloat64(value)
+		if !ok {
+			return fmt.Errorf("field '%v' is not numeric, got %T", field, value)
+		}
+		if agg.count == 0 {
+			agg.min, agg.max = f, f
+		} else {
+			if f < agg.min {
+				agg.min = f
+			}
+			if f > agg.max {
+				agg.max = f
+			}
+		}
+		agg.count++
+		agg.sum += f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
+
+// Distinct returns the unique values of an indexed field, in the order the
+// index stores them. Only the keys are listed — record bodies are never read
+// — and each distinct encoded value is decoded back through the inverse of
+// the key encoding. The field must carry an equality index of its own.
+func (d *db) Distinct(field string) ([]interface{}, error) {
+	for _, idx := range d.options.Indexes {
+		if idx.FieldName != field || idx.Type != indexTypeEq || len(idx.FieldNames) > 1 {
+			continue
+		}
+		if idx.OrderFieldName != "" && idx.OrderFieldName != idx.FieldName {
+			continue
+		}
+		prefix := fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(idx))
+		keys, err := d.options.Store.List(store.ListPrefix(prefix))
+		if err != nil {
+			return nil, err
+		}
+		values := []interface{}{}
+		lastKey := ""
+		for _, key := range keys {
+			fieldKey := key[len(prefix):]
+			// strip the trailing record id
+			if j := strings.LastIndex(fieldKey, ":"); j >= 0 {
+				fieldKey = fieldKey[:j]
+			}
+			// the keys are sorted, so duplicates are adjacent
+			if fieldKey == lastKey && len(values) > 0 {
+				continue
+			}
+			lastKey = fieldKey
+			value, err := d.decodeFieldKey(idx, fieldKey)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("field '%v' does not carry an equality index", field)
+}
+
+// GroupByCount tallies the number of records per distinct value of an
+// indexed field, keyed by the value's string form. Like Distinct it walks
+// only the index keys. A positive limit caps the number of groups returned,
+// in index order; zero means all groups.
+func (d *db) GroupByCount(field string, limit int64) (map[string]int64, error) {
+	for _, idx := range d.options.Indexes {
+		if idx.FieldName != field || idx.Type != indexTypeEq || len(idx.FieldNames) > 1 {
+			continue
+		}
+		if idx.OrderFieldName != "" && idx.OrderFieldName != idx.FieldName {
+			continue
+		}
+		prefix := fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(idx))
+		keys, err := d.options.Store.List(store.ListPrefix(prefix))
+		if err != nil {
+			return nil, err
+		}
+		groups := map[string]int64{}
+		lastKey := ""
+		lastGroup := ""
+		for _, key := range keys {
+			fieldKey := key[len(prefix):]
+			if j := strings.LastIndex(fieldKey, ":"); j >= 0 {
+				fieldKey = fieldKey[:j]
+			}
+			if fieldKey != lastKey || lastGroup == "" {
+				if limit > 0 && int64(len(groups)) >= limit {
+					break
+				}
+				value, err := d.decodeFieldKey(idx, fieldKey)
+				if err != nil {
+					return nil, err
+				}
+				lastKey = fieldKey
+				lastGroup = fmt.Sprintf("%v", value)
+			}
+			groups[lastGroup]++
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("field '%v' does not carry an equality index", field)
+}
+
+// Sum adds up the named numeric field over all records matching the query.
+// An empty result sums to zero.
+func (d *db) Sum(query Query, field string) (float64, error) {
+	agg, err := d.aggregateField(query, field)
+	if err != nil {
+		return 0, err
+	}
+	return agg.sum, nil
+}
+
+// Avg averages the named numeric field over all records matching the query.
+// An empty result averages to zero.
+func (d *db) Avg(query Query, field string) (float64, error) {
+	agg, err := d.aggregateField(query, field)
+	if err != nil {
+		return 0, err
+	}
+	if agg.count == 0 {
+		return 0, nil
+	}
+	return agg.sum / float64(agg.count), nil
+}
+
+// Min returns the smallest value of the named numeric field over the records
+// matching the query, or ErrorNotFound when nothing matches. When the scan
+// order of the matching index follows the field, only the edge record is read.
+func (d *db) Min(query Query, field string) (float64, error) {
+	if f, ok, err := d.edgeValue(query, field, false); ok || err != nil {
+		return f, err
+	}
+	agg, err := d.aggregateField(query, field)
+	if err != nil {
+		return 0, err
+	}
+	if agg.count == 0 {
+		return 0, ErrorNotFound
+	}
+	return agg.min, nil
+}
+
+// Max returns the largest value of the named numeric field over the records
+// matching the query, or ErrorNotFound when nothing matches. When the scan
+// order of the matching index follows the field, only the edge record is read.
+func (d *db) Max(query Query, field string) (float64, error) {
+	if f, ok, err := d.edgeValue(query, field, true); ok || err != nil {
+		return f, err
+	}
+	agg, err := d.aggregateField(query, field)
+	if err != nil {
+		return 0, err
+	}
+	if agg.count == 0 {
+		return 0, ErrorNotFound
+	}
+	return agg.max, nil
+}
+
+// edgeValue answers Min and Max straight off the index when the keys the
+// query scans are already ordered by the aggregated field: the smallest
+// value is the first record of the prefix and the largest sits under the
+// last key. It reports false when the shortcut does not apply.
+func (d *db) edgeValue(query Query, field string, largest bool) (float64, bool, error) {
+	if query.Type != queryTypeEq || d.options.SoftDelete {
+		return 0, false, nil
+	}
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		orderedBy := idx.FieldName
+		if idx.OrderFieldName != "" {
+			orderedBy = idx.OrderFieldName
+		}
+		if orderedBy != field || !idx.Ordered {
+			return 0, false, nil
+		}
+		k, err := d.queryToListKey(context.Background(), idx, query)
+		if err != nil {
+			return 0, false, err
+		}
+		// on a descending index the largest value comes first
+		first := largest == idx.Desc
+		var rec *store.Record
+		if first {
+			recs, err := d.options.Store.Read(k, store.ReadPrefix(), store.ReadLimit(1))
+			if err != nil {
+				return 0, false, err
+			}
+			if len(recs) > 0 {
+				rec = recs[0]
+			}
+		} else {
+			keys, err := d.options.Store.List(store.ListPrefix(k))
+			if err != nil {
+				return 0, false, err
+			}
+			if len(keys) > 0 {
+				recs, err := d.options.Store.Read(keys[len(keys)-1])
+				if err != nil {
+					return 0, false, err
+				}
+				if len(recs) > 0 {
+					rec = recs[0]
+				}
+			}
+		}
+		if rec == nil {
+			return 0, true, ErrorNotFound
+		}
+		deref, err := d.dereference(idx, []*store.Record{rec})
+		if err != nil {
+			return 0, true, err
+		}
+		if len(deref) == 0 {
+			return 0, true, ErrorNotFound
+		}
+		rec = deref[0]
+		m := map[string]interface{}{}
+		if err := d.decode(rec.Value, &m); err != nil {
+			return 0, true, err
+		}
+		value, err := resolveFieldValue(m, field)
+		if err != nil {
+			return 0, true, err
+		}
+		f, ok := toFloat64(value)
+		if !ok {
+			return 0, true, fmt.Errorf("field '%v' is not numeric, got %T", field, value)
+		}
+		return f, true, nil
+	}
+	return 0, false, nil
+}
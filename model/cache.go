@@ -0,0 +1,78 @@
+package model
+
+import (
+	"container/list"
+	"sync"
+)
+
+// readCache is a fixed size LRU of raw record values keyed by id. It serves
+// repeated reads of hot records without touching the store; the save and
+// delete paths evict the id they touch so a cached entry never outlives the
+// record state it was read from.
+type readCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	id    string
+	value []byte
+}
+
+func newReadCache(size int) *readCache {
+	return &readCache{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// get returns the cached value for an id and marks it most recently used.
+func (c *readCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// set stores a value for an id, evicting the least recently used entry when
+// the cache is full.
+func (c *readCache) set(id string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*cacheEntry).value = value
+		return
+	}
+	c.items[id] = c.ll.PushFront(&cacheEntry{id: id, value: value})
+	if c.ll.Len() > c.size {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*cacheEntry).id)
+	}
+}
+
+// evict drops the entry for an id, if cached.
+func (c *readCache) evict(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// clear drops every entry.
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
@@ -0,0 +1,3 @@
+module github.com/micro/website/model
+
+go 1.21
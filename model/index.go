@@ -0,0 +1,658 @@
+package model
+
+import (
+	"context"
+	"encoding"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	indexTypeEq         = "eq"
+	queryTypeEq         = "eq"
+	queryTypeNotEq      = "notEq"
+	queryTypeGt         = "gt"
+	queryTypeLt         = "lt"
+	queryTypeBetween    = "between"
+	queryTypeStartsWith = "startsWith"
+)
+
+// Index maintains a set of keys for a field so queries against that field
+// become cheap prefix reads against the store.
+type Index struct {
+	// FieldName is the name of the indexed field as it appears in the
+	// record's JSON representation. For composite indexes it is the sorted,
+	// comma joined field names.
+	FieldName string
+	// FieldNames holds the component fields of a composite index, in the
+	// deterministic order they appear in the key
+	FieldNames []string
+	// KeyName overrides the index's derived key segment, eg. "byTitle" for
+	// a field "title". The derived name title-cases the field, so fields
+	// differing only in case collide; an explicit name keeps them apart and
+	// gives external tools a stable key layout. Changing it on existing
+	// data orphans the old keys until a Reindex.
+	KeyName string
+	// OrderFieldName, when set to a different field than FieldName, makes
+	// the index filter on FieldName but order its keys by this field. The
+	// Desc and ordering options apply to the order field.
+	OrderFieldName string
+	// Type of index, eg. equality
+	Type string
+	// Ordered index keys are encoded so that reading them back in key
+	// order returns records ordered by the field value
+	Ordered bool
+	// Desc inverts the key encoding so that an ascending read of the keys
+	// returns values in descending order
+	Desc bool
+	// Unique indexes refuse a Save when a different record already owns
+	// the indexed value
+	Unique bool
+	// MultiValue indexes a slice field with one key per element, so an
+	// equality query on a single element finds every record containing it
+	MultiValue bool
+	// KeyTransform, when set, normalizes string values before they are
+	// encoded into keys, eg. trimming whitespace or stripping accents. The
+	// stored record keeps the original value; only the key is transformed.
+	// It runs on both the save and the query path, so lookups match as long
+	// as the transform is deterministic.
+	KeyTransform func(string) string
+	// CaseInsensitive folds string values to lower case before they are
+	// encoded into keys, so lookups and unique checks ignore casing. The
+	// stored record keeps its original casing; only the key is folded.
+	CaseInsensitive bool
+	// Encrypted marks a field whose values must not appear in store keys.
+	// Its keys hold a deterministic HMAC of the value instead of an ordered
+	// encoding, keyed by the model's CipherIndexKey. Equal values still map
+	// to equal keys, so Equals queries work, but the digests carry no order:
+	// range, StartsWith and ordered listings over the field are rejected.
+	Encrypted bool
+	// Base32Encode encodes string values before they appear in keys. Handy
+	// when values contain characters that are awkward in keys.
+	Base32Encode bool
+	// StringOrderPadLength is the fixed length string values are padded to
+	// in ordered indexes so shorter values do not interleave with longer ones
+	StringOrderPadLength int
+}
+
+// ByEquality constructs an equality index on fieldName.
+func ByEquality(fieldName string) Index {
+	return Index{
+		FieldName:            fieldName,
+		Type:                 indexTypeEq,
+		Ordered:              true,
+		StringOrderPadLength: 16,
+	}
+}
+
+// ByEqualityOrderedBy constructs an equality index on fieldName whose keys
+// are ordered by a different field, eg. posts filtered by category and
+// listed by score. With desc the highest order value comes back first.
+func ByEqualityOrderedBy(fieldName, orderFieldName string, desc bool) Index {
+	idx := ByEquality(fieldName)
+	idx.OrderFieldName = orderFieldName
+	idx.Desc = desc
+	return idx
+}
+
+// ByEqualities constructs a composite equality index over several fields.
+// The encoded value of every component field is concatenated into one key,
+// in sorted field order so the key layout is deterministic, with each
+// component separator escaped. Query it with EqualsPairs over the same set
+// of fields.
+func ByEqualities(fieldNames ...string) Index {
+	sorted := append([]string{}, fieldNames...)
+	sort.Strings(sorted)
+	idx := ByEquality(strings.Join(sorted, ","))
+	idx.FieldNames = sorted
+	return idx
+}
+
+// indexName returns the key segment identifying an index, eg. "byEmail".
+// An explicit KeyName wins over the derived name. The derivation only folds
+// the first rune — title-casing the whole name mapped "userName" and
+// "username", or "a.b" and "a.B", to the same segment, silently sharing one
+// index namespace. The one remaining ambiguity, fields differing only in
+// their leading rune, is rejected at construction.
+func indexName(i Index) string {
+	if i.KeyName != "" {
+		return i.KeyName
+	}
+	r, size := utf8.DecodeRuneInString(i.FieldName)
+	return "by" + string(unicode.ToUpper(r)) + i.FieldName[size:]
+}
+
+// indexMatchesQuery returns true if the index can serve the query. The
+// query's direction does not have to match the index's physical one — the
+// read paths reverse mismatched results in memory.
+func indexMatchesQuery(i Index, q Query) bool {
+	if i.FieldName != q.FieldName {
+		return false
+	}
+	if q.Type == queryTypeEq {
+		// a point lookup fully specifies the value, so the physical order of
+		// the index cannot change what matches — the list key is encoded in
+		// the index's own key format either way. Without this an index
+		// declared unordered would not serve a query built with the default
+		// ascending order, and vice versa. A nil value lists the entire
+		// index, which likewise comes back in whatever order it has.
+		return i.Type == indexTypeEq
+	}
+	if i.Ordered != q.Ordered {
+		return false
+	}
+	switch q.Type {
+	case queryTypeEq:
+		return i.Type == indexTypeEq
+	case queryTypeGt, queryTypeLt, queryTypeBetween, queryTypeNotEq:
+		// range and exclusion queries run off the ordered key encoding of
+		// equality indexes
+		return i.Type == indexTypeEq && i.Ordered
+	case queryTypeStartsWith:
+		// prefix queries rely on the ordered string encoding, an unordered
+		// index stores keys in a different format
+		return i.Type == indexTypeEq && i.Ordered
+	}
+	return false
+}
+
+// indexToKey returns the store key for a record in an index. With appendID
+// the record id is appended, which makes the key unique per record. The
+// context supplies the tenant scope of the key, if any.
+func (d *db) indexToKey(ctx context.Context, i Index, id string, fieldValue interface{}, appendID bool) (string, error) {
+	fieldKey, err := d.getFieldKey(i, fieldValue)
+	if err != nil {
+		return "", err
+	}
+	if appendID {
+		return fmt.Sprintf("%v:%v:%v:%v", d.namespace(ctx), indexName(i), fieldKey, encodeIDPart(id)), nil
+	}
+	return fmt.Sprintf("%v:%v:%v", d.namespace(ctx), indexName(i), fieldKey), nil
+}
+
+// encodeIDPart encodes the record id appended to index keys. Because the id
+// is the only part of the key differing between records with equal field
+// values, it is the effective secondary sort: integer ids are zero padded so
+// they order numerically, anything else orders by its escaped string form.
+// Either way, records sharing a primary value come back ordered by id.
+func encodeIDPart(id string) string {
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return fmt.Sprintf("%020d", n)
+	}
+	return escapeKeyPart(id)
+}
+
+// escapeKeyPart escapes the key separator, and the escape character itself,
+// so values containing ':' cannot shift the key boundaries or shadow other
+// records. Both the save path and the query path encode through here, so the
+// escaping stays symmetric.
+func escapeKeyPart(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	return strings.ReplaceAll(s, ":", "%3A")
+}
+
+// queryToListKey returns the key prefix to scan for a query, scoped to the
+// tenant carried on the context, if any.
+func (d *db) queryToListKey(ctx context.Context, i Index, q Query) (string, error) {
+	if q.Value == nil {
+		// a nil value lists the whole index: the prefix stops at the index
+		// name, so every key in it matches, in the index's natural key order
+		return fmt.Sprintf("%v:%v:", d.namespace(ctx), indexName(i)), nil
+	}
+	if i.OrderFieldName != "" && i.OrderFieldName != i.FieldName {
+		// only the filter value goes into the prefix; the order field value
+		// follows it in the stored keys, so the prefix read comes back in
+		// order field order
+		raw, err := d.getRawFieldKey(i, i.FieldName, q.Value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v:%v:%v", d.namespace(ctx), indexName(i), escapeKeyPart(raw)), nil
+	}
+	fieldKey, err := d.getFieldKey(i, q.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v:%v:%v", d.namespace(ctx), indexName(i), fieldKey), nil
+}
+
+// getFieldKey encodes a field value for use in a key. Composite indexes and
+// indexes ordered by a separate field are passed the decoded record map and
+// encode each of their fields in turn.
+func (d *db) getFieldKey(i Index, fieldValue interface{}) (string, error) {
+	if i.OrderFieldName != "" && i.OrderFieldName != i.FieldName {
+		m, ok := fieldValue.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("index on '%v' ordered by '%v' requires a map of values, got %T", i.FieldName, i.OrderFieldName, fieldValue)
+		}
+		filterValue, err := resolveFieldValue(m, i.FieldName)
+		if err != nil {
+			return "", err
+		}
+		filterKey, err := d.getRawFieldKey(i, i.FieldName, filterValue)
+		if err != nil {
+			return "", err
+		}
+		orderValue, err := resolveFieldValue(m, i.OrderFieldName)
+		if err != nil {
+			return "", err
+		}
+		orderKey, err := d.getRawFieldKey(i, i.OrderFieldName, orderValue)
+		if err != nil {
+			return "", err
+		}
+		return escapeKeyPart(filterKey) + ":" + escapeKeyPart(orderKey), nil
+	}
+	if len(i.FieldNames) > 1 {
+		m, ok := fieldValue.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("composite index '%v' requires a map of values, got %T", i.FieldName, fieldValue)
+		}
+		parts := make([]string, len(i.FieldNames))
+		for j, fn := range i.FieldNames {
+			value, err := resolveFieldValue(m, fn)
+			if err != nil {
+				return "", err
+			}
+			raw, err := d.getRawFieldKey(i, fn, value)
+			if err != nil {
+				return "", err
+			}
+			parts[j] = escapeKeyPart(raw)
+		}
+		return strings.Join(parts, ":"), nil
+	}
+	raw, err := d.getRawFieldKey(i, i.FieldName, fieldValue)
+	if err != nil {
+		return "", err
+	}
+	return escapeKeyPart(raw), nil
+}
+
+func (d *db) getRawFieldKey(i Index, fieldName string, fieldValue interface{}) (string, error) {
+	if i.Encrypted {
+		// the digest replaces every other encoding so the plain value never
+		// reaches the key, ordered or not
+		return d.hmacFieldKey(fieldValue)
+	}
+	if !i.Ordered {
+		if s, ok := fieldValue.(string); ok {
+			if i.KeyTransform != nil {
+				s = i.KeyTransform(s)
+			}
+			if i.CaseInsensitive {
+				s = strings.ToLower(s)
+			}
+			return s, nil
+		}
+		if tm, ok := fieldValue.(encoding.TextMarshaler); ok {
+			if b, err := tm.MarshalText(); err == nil {
+				return string(b), nil
+			}
+		}
+		return fmt.Sprintf("%v", fieldValue), nil
+	}
+	switch v := fieldValue.(type) {
+	case string:
+		// a json decode of a saved record turns time values back into
+		// RFC3339 strings. Detect those and route them to the time encoding
+		// so they produce the same key as the time.Time they came from.
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return d.getOrderedIntFieldKey(i, t.UnixNano()), nil
+		}
+		return d.getOrderedStringFieldKey(i, v), nil
+	case float64:
+		// json numbers arrive as float64. Whole and fractional values share
+		// the split integer/fraction encoding, so they sort against each
+		// other and keep matching the int typed query values, which produce
+		// the same keys through the integer encoding.
+		return d.getOrderedFloatFieldKey(i, fieldName, v)
+	case json.Number:
+		// callers passing maps can hand over json.Number values, which keep
+		// full precision where float64 cannot
+		if n, err := v.Int64(); err == nil {
+			return d.getOrderedIntFieldKey(i, n), nil
+		}
+		// a positive value too large for int64, eg. a uint64 counter
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return d.getOrderedUintFieldKey(i, u), nil
+		}
+		// an integer past even the uint64 range must not silently fall into
+		// the float encoding — the precision loss would produce a bad sort
+		// key, and for unique fields false collisions
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return "", fmt.Errorf("field '%v' has an integer value '%v' outside the encodable range", fieldName, v)
+		}
+		if f, err := v.Float64(); err == nil {
+			return d.getOrderedFloatFieldKey(i, fieldName, f)
+		}
+		return "", fmt.Errorf("field '%v' has a json.Number value '%v' the index cannot encode", fieldName, v)
+	case float32:
+		// widen through the shortest decimal representation, the same value
+		// a json round trip of the float32 produces, so the key matches the
+		// decoded form of the stored record
+		f, err := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		if err != nil {
+			return "", fmt.Errorf("field '%v' has a float32 value '%v' the index cannot encode", fieldName, v)
+		}
+		return d.getRawFieldKey(i, fieldName, f)
+	case int:
+		return d.getOrderedIntFieldKey(i, int64(v)), nil
+	case int8:
+		return d.getOrderedIntFieldKey(i, int64(v)), nil
+	case int16:
+		return d.getOrderedIntFieldKey(i, int64(v)), nil
+	case int32:
+		return d.getOrderedIntFieldKey(i, int64(v)), nil
+	case int64:
+		return d.getOrderedIntFieldKey(i, v), nil
+	case uint:
+		return d.getOrderedUintFieldKey(i, uint64(v)), nil
+	case uint8:
+		return d.getOrderedUintFieldKey(i, uint64(v)), nil
+	case uint16:
+		return d.getOrderedUintFieldKey(i, uint64(v)), nil
+	case uint32:
+		return d.getOrderedUintFieldKey(i, uint64(v)), nil
+	case uint64:
+		return d.getOrderedUintFieldKey(i, v), nil
+	case bool:
+		// encode as 0/1 so the keys sort false before true; descending
+		// indexes flip the bit like the other encodings flip theirs
+		if v != i.Desc {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		// times take the integer encoding of their UnixNano so ascending
+		// and descending time ranges work like any other number
+		return d.getOrderedIntFieldKey(i, v.UnixNano()), nil
+	}
+	// custom types fall through the concrete type switch. A TextMarshaler
+	// keys on its marshaled text, ordered like a string — the json encoder
+	// uses the same text, so queries line up with the decoded form of the
+	// stored records. The ordering follows the textual form, not whatever
+	// value backs it.
+	if tm, ok := fieldValue.(encoding.TextMarshaler); ok {
+		if b, err := tm.MarshalText(); err == nil {
+			return d.getOrderedStringFieldKey(i, string(b)), nil
+		}
+	}
+	// named basic types, eg. an int backed enum, take the encoding of their
+	// underlying kind — the same key the json decode of a stored record
+	// produces for them
+	rv := reflect.ValueOf(fieldValue)
+	switch rv.Kind() {
+	case reflect.String:
+		return d.getRawFieldKey(i, fieldName, rv.String())
+	case reflect.Bool:
+		return d.getRawFieldKey(i, fieldName, rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return d.getOrderedIntFieldKey(i, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return d.getOrderedUintFieldKey(i, rv.Uint()), nil
+	case reflect.Float32:
+		return d.getRawFieldKey(i, fieldName, float32(rv.Float()))
+	case reflect.Float64:
+		return d.getRawFieldKey(i, fieldName, rv.Float())
+	}
+	// a Stringer without a kind the encoders know keys on its string form.
+	// The json encoder ignores Stringer, so this only lines up with stored
+	// records whose json form is that same text.
+	if s, ok := fieldValue.(fmt.Stringer); ok {
+		return d.getOrderedStringFieldKey(i, s.String()), nil
+	}
+	return "", fmt.Errorf("field '%v' has a type (%T) the index cannot encode", fieldName, fieldValue)
+}
+
+// unescapeKeyPart reverses escapeKeyPart.
+func unescapeKeyPart(s string) string {
+	s = strings.ReplaceAll(s, "%3A", ":")
+	return strings.ReplaceAll(s, "%25", "%")
+}
+
+// decodeFieldKey reverses the ordered encodings and recovers the field value
+// out of an index key segment. The type is inferred from the encoded shape:
+// 36 characters of 20 digits and 16 hex is the numeric encoding — decoded
+// to an integer when the fraction is zero, a float otherwise — a single 0/1
+// a boolean, anything else a string. A string value that happens to take one
+// of those shapes is decoded as the number it looks like.
+func (d *db) decodeFieldKey(i Index, fieldKey string) (interface{}, error) {
+	raw := unescapeKeyPart(fieldKey)
+	if !i.Ordered {
+		return raw, nil
+	}
+	if len(raw) == 36 {
+		if biased, ok := new(big.Int).SetString(raw[:20], 10); ok {
+			if bits, err := strconv.ParseUint(raw[20:], 16, 64); err == nil {
+				// the sentinels of the non-finite values are fixed strings,
+				// matched ahead of the descending un-complement — on a Desc
+				// index the stored fraction bits of every finite key are
+				// complemented too, so their shape only becomes checkable
+				// after the inversion
+				if v, ok := nonFiniteKeyValues(i)[raw]; ok {
+					return v, nil
+				}
+				if i.Desc {
+					biased.Sub(numericKeyLimit, biased)
+					biased.Sub(biased, big.NewInt(1))
+					bits = ^bits
+				}
+				if bits&(1<<63) == 0 || biased.Sign() < 0 || biased.Cmp(numericKeyLimit) >= 0 {
+					return nil, fmt.Errorf("field key '%v' is not a valid numeric encoding", raw)
+				}
+				whole := biased.Sub(biased, numericKeyBias)
+				fraction := math.Float64frombits(bits &^ (1 << 63))
+				if fraction == 0 {
+					if whole.IsInt64() {
+						return whole.Int64(), nil
+					}
+					return whole.Uint64(), nil
+				}
+				wf, _ := new(big.Float).SetInt(whole).Float64()
+				return wf + fraction, nil
+			}
+		}
+	}
+	if raw == "0" || raw == "1" {
+		return (raw == "1") != i.Desc, nil
+	}
+	if i.Base32Encode {
+		decoded, err := base32.HexEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field key '%v' is not valid base32: %v", fieldKey, err)
+		}
+		raw = string(decoded)
+	}
+	runes := []rune(raw)
+	if i.Desc {
+		for j, r := range runes {
+			runes[j] = utf8.MaxRune - r
+		}
+	}
+	// strip the padding, which decodes to the minimum rune either way
+	end := len(runes)
+	for end > 0 && runes[end-1] == 0 {
+		end--
+	}
+	return string(runes[:end]), nil
+}
+
+// nonFiniteKeyValues maps the sentinel keys of getOrderedFloatFieldKey to
+// the non-finite values they encode, per index direction.
+func nonFiniteKeyValues(i Index) map[string]float64 {
+	if i.Desc {
+		return map[string]float64{
+			"99999999999999999999ffffffffffffffff": math.Inf(-1),
+			"000000000000000000000000000000000001": math.Inf(1),
+			"000000000000000000000000000000000000": math.NaN(),
+		}
+	}
+	return map[string]float64{
+		"000000000000000000000000000000000000": math.Inf(-1),
+		"99999999999999999998ffffffffffffffff": math.Inf(1),
+		"99999999999999999999ffffffffffffffff": math.NaN(),
+	}
+}
+
+// numericKeyBias shifts the integer part of a numeric key into unsigned
+// space, mapping negative values monotonically below positive ones. The
+// biased values of the full int64 and uint64 ranges together span
+// [0, 3*2^63), one contiguous 20 digit space, so signed, unsigned and
+// floating point values of one field sort against each other without
+// colliding. numericKeyLimit is one past that space and anchors the
+// descending complement.
+var (
+	numericKeyBias  = new(big.Int).Lsh(big.NewInt(1), 63)
+	numericKeyLimit = new(big.Int).Lsh(big.NewInt(3), 63)
+)
+
+// getOrderedNumericFieldKey encodes a number as its biased integer part in
+// 20 decimal digits followed by the IEEE-754 bits of its fractional part in
+// 16 hex digits. The one fixed-width format covers integers, unsigned
+// integers and floats, so whole and fractional values of one field sort
+// numerically against each other, and an int typed query value produces
+// the same key as the json decode of the float it was stored as. The
+// fraction lies in [0, 1), where the raw IEEE-754 bits are already
+// monotone; its high bit marks the fraction half of a finite key.
+// Descending indexes store the complement of both parts. The caller
+// guarantees the integer part is within [-2^63, 2^64).
+func (d *db) getOrderedNumericFieldKey(i Index, whole *big.Int, fraction float64) string {
+	biased := new(big.Int).Add(whole, numericKeyBias)
+	if i.Desc {
+		biased.Sub(numericKeyLimit, biased)
+		biased.Sub(biased, big.NewInt(1))
+	}
+	bits := math.Float64bits(fraction) | 1<<63
+	if i.Desc {
+		bits = ^bits
+	}
+	return fmt.Sprintf("%020d%016x", biased, bits)
+}
+
+// getOrderedIntFieldKey encodes an integer through the shared numeric key
+// format, with a zero fraction.
+func (d *db) getOrderedIntFieldKey(i Index, v int64) string {
+	return d.getOrderedNumericFieldKey(i, big.NewInt(v), 0)
+}
+
+// getOrderedUintFieldKey encodes an unsigned integer through the shared
+// numeric key format. Values past the int64 range land directly above the
+// biased signed space, disjoint from it and sorted after it, so a large
+// unsigned value can neither collide with nor sort below a smaller signed
+// one.
+func (d *db) getOrderedUintFieldKey(i Index, v uint64) string {
+	return d.getOrderedNumericFieldKey(i, new(big.Int).SetUint64(v), 0)
+}
+
+// getOrderedFloatFieldKey splits a float into its integer and fractional
+// parts and encodes them through the shared numeric key format. -Inf and
+// +Inf take sentinel keys outside the biased integer space, below and above
+// every finite value, with NaN just outside +Inf; a float whose integer
+// part leaves the encodable [-2^63, 2^64) range is rejected like the over
+// range json.Number integers, rather than encoded to a corrupt sort key.
+func (d *db) getOrderedFloatFieldKey(i Index, fieldName string, v float64) (string, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		if i.Desc {
+			switch {
+			case math.IsInf(v, -1):
+				return "99999999999999999999ffffffffffffffff", nil
+			case math.IsInf(v, 1):
+				return "000000000000000000000000000000000001", nil
+			default:
+				return "000000000000000000000000000000000000", nil
+			}
+		}
+		switch {
+		case math.IsInf(v, -1):
+			return "000000000000000000000000000000000000", nil
+		case math.IsInf(v, 1):
+			return "99999999999999999998ffffffffffffffff", nil
+		default:
+			return "99999999999999999999ffffffffffffffff", nil
+		}
+	}
+	n := math.Floor(v)
+	if n < math.MinInt64 || n >= math.Ldexp(1, 64) {
+		return "", fmt.Errorf("field '%v' has a value '%v' outside the encodable range", fieldName, v)
+	}
+	whole, _ := new(big.Float).SetFloat64(n).Int(nil)
+	return d.getOrderedNumericFieldKey(i, whole, v-n), nil
+}
+
+// getOrderedStringPrefixKey encodes a query term the way the start of a
+// stored string key would be encoded, without padding it to full length, so
+// it can serve as a store prefix. Base32 output is truncated to complete
+// encoding groups — the caller has to re-check matches against the decoded
+// values, since a partial group cannot be encoded unambiguously.
+func (d *db) getOrderedStringPrefixKey(i Index, term string) string {
+	if i.KeyTransform != nil {
+		term = i.KeyTransform(term)
+	}
+	if i.CaseInsensitive {
+		term = strings.ToLower(term)
+	}
+	runes := []rune(term)
+	if i.Desc {
+		for j, r := range runes {
+			runes[j] = utf8.MaxRune - r
+		}
+	}
+	if i.Base32Encode {
+		encoded := base32.HexEncoding.EncodeToString([]byte(string(runes)))
+		complete := len([]byte(string(runes))) / 5 * 8
+		return encoded[:complete]
+	}
+	return string(runes)
+}
+
+// getOrderedStringFieldKey pads and optionally encodes a string so the
+// resulting keys sort in the order of the original values.
+func (d *db) getOrderedStringFieldKey(i Index, fieldValue string) string {
+	if i.KeyTransform != nil {
+		// the transform runs ahead of the casing fold, on the save path and
+		// the query path alike
+		fieldValue = i.KeyTransform(fieldValue)
+	}
+	if i.CaseInsensitive {
+		// both the save path and the query path encode through here, so the
+		// folding stays symmetric
+		fieldValue = strings.ToLower(fieldValue)
+	}
+	runes := []rune(fieldValue)
+	if i.Desc {
+		// invert each rune so an ascending read of the keys yields the
+		// values in descending order
+		for j, r := range runes {
+			runes[j] = utf8.MaxRune - r
+		}
+	}
+	// pad with the minimum rune so a short string sorts before every longer
+	// string sharing its prefix; in the inverted descending space that
+	// minimum is the maximum rune. The NUL padding is not pretty in a key
+	// listing — set Base32Encode for display safe keys.
+	pad := rune(0)
+	if i.Desc {
+		pad = utf8.MaxRune
+	}
+	for len(runes) < i.StringOrderPadLength {
+		runes = append(runes, pad)
+	}
+	if i.Base32Encode {
+		// the extended hex alphabet sorts in byte order, unlike the standard
+		// one, so encoding keeps the keys in the same relative order in both
+		// directions
+		return base32.HexEncoding.EncodeToString([]byte(string(runes)))
+	}
+	return string(runes)
+}
@@ -0,0 +1,229 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/micro/website/model/store"
+)
+
+// Inconsistency types reported by Verify.
+const (
+	// InconsistencyOrphan is a secondary index key whose record no longer
+	// exists in the id index.
+	InconsistencyOrphan = "orphan"
+	// InconsistencyMissing is a secondary index key a record should have but
+	// does not.
+	InconsistencyMissing = "missing"
+)
+
+// Inconsistency is one divergence between the id index and a secondary
+// index, found by Verify.
+type Inconsistency struct {
+	// Type is one of InconsistencyOrphan or InconsistencyMissing
+	Type string
+	// Key is the secondary index key involved
+	Key string
+	// ID of the record the key refers to
+	ID string
+}
+
+// expectedEntry is one secondary index key a record in the id index should
+// have, together with what it should hold.
+type expectedEntry struct {
+	id    string
+	value []byte
+}
+
+// scanExpected walks the id index, the source of truth for full records, and
+// computes every secondary index key the current index set expects.
+func (d *db) scanExpected() (map[string]expectedEntry, error) {
+	idPrefix := fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(d.idIndex))
+	idKeys, err := d.options.Store.List(store.ListPrefix(idPrefix))
+	if err != nil {
+		return nil, err
+	}
+	expected := map[string]expectedEntry{}
+	for _, idKey := range idKeys {
+		recs, err := d.options.Store.Read(idKey)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		if err := d.decode(recs[0].Value, &m); err != nil {
+			return nil, err
+		}
+		idValue, ok := m[d.options.IDField]
+		if !ok {
+			return nil, fmt.Errorf("record under key '%v' has no '%v' field", idKey, d.options.IDField)
+		}
+		id := fmt.Sprintf("%v", idValue)
+		for _, idx := range d.options.Indexes {
+			value, err := indexFieldValue(idx, m)
+			if err != nil {
+				return nil, err
+			}
+			values, err := indexValues(idx, value)
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				key, err := d.indexToKey(context.Background(), idx, id, value, true)
+				if err != nil {
+					return nil, err
+				}
+				expected[key] = expectedEntry{id: id, value: recs[0].Value}
+			}
+		}
+	}
+	return expected, nil
+}
+
+// Verify cross-checks every secondary index against the id index and reports
+// the divergences: orphaned keys whose record is gone, and records missing a
+// secondary key they should have. A healthy model reports nothing. It is a
+// diagnostics tool — nothing is modified; pass the findings to Repair to fix
+// them.
+func (d *db) Verify() ([]Inconsistency, error) {
+	expected, err := d.scanExpected()
+	if err != nil {
+		return nil, err
+	}
+	allKeys, err := d.options.Store.List(store.ListPrefix(fmt.Sprintf("%v:", d.options.Namespace)))
+	if err != nil {
+		return nil, err
+	}
+	idPrefix := fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(d.idIndex))
+	counterKey := fmt.Sprintf("%v:idCounter", d.options.Namespace)
+	found := []Inconsistency{}
+	actual := map[string]bool{}
+	for _, key := range allKeys {
+		if strings.HasPrefix(key, idPrefix) || key == counterKey {
+			continue
+		}
+		actual[key] = true
+		if _, ok := expected[key]; !ok {
+			// the trailing segment of the key is the record id
+			id := ""
+			if j := strings.LastIndex(key, ":"); j >= 0 {
+				id = unescapeKeyPart(key[j+1:])
+			}
+			found = append(found, Inconsistency{Type: InconsistencyOrphan, Key: key, ID: id})
+		}
+	}
+	for key, entry := range expected {
+		if !actual[key] {
+			found = append(found, Inconsistency{Type: InconsistencyMissing, Key: key, ID: entry.id})
+		}
+	}
+	return found, nil
+}
+
+// Repair fixes what Verify finds: orphaned index keys are deleted and
+// missing ones are backfilled from the id index copy of the record. It
+// returns the inconsistencies that were repaired.
+func (d *db) Repair() ([]Inconsistency, error) {
+	expected, err := d.scanExpected()
+	if err != nil {
+		return nil, err
+	}
+	found, err := d.Verify()
+	if err != nil {
+		return nil, err
+	}
+	for _, inc := range found {
+		switch inc.Type {
+		case InconsistencyOrphan:
+			if err := d.options.Store.Delete(inc.Key); err != nil {
+				return nil, err
+			}
+		case InconsistencyMissing:
+			entry := expected[inc.Key]
+			if err := d.options.Store.Write(&store.Record{Key: inc.Key, Value: entry.value}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return found, nil
+}
+
+// Reindex rebuilds the secondary indexes from the id index, which holds the
+// authoritative copy of every record. Each record is re-written under all of
+// the currently configured indexes, and keys left behind by indexes that are
+// no longer configured are removed afterwards. Run it after changing the
+// index set of a model with existing data — records saved before a new index
+// was added carry no key under it until they are reindexed. The walk is one
+// record at a time and every step is idempotent, so an interrupted run can
+// simply be started again.
+func (d *db) Reindex() error {
+	idPrefix := fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(d.idIndex))
+	idKeys, err := d.options.Store.List(store.ListPrefix(idPrefix))
+	if err != nil {
+		return err
+	}
+	// every key the current index set expects, used to sweep out strays
+	expected := map[string]bool{}
+	for i, idKey := range idKeys {
+		recs, err := d.options.Store.Read(idKey)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m := map[string]interface{}{}
+		if err := d.decode(recs[0].Value, &m); err != nil {
+			return err
+		}
+		idValue, ok := m[d.options.IDField]
+		if !ok {
+			return fmt.Errorf("record under key '%v' has no '%v' field", idKey, d.options.IDField)
+		}
+		id := fmt.Sprintf("%v", idValue)
+		for _, idx := range d.options.Indexes {
+			value, err := indexFieldValue(idx, m)
+			if err != nil {
+				return err
+			}
+			values, err := indexValues(idx, value)
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				key, err := d.indexToKey(context.Background(), idx, id, value, true)
+				if err != nil {
+					return err
+				}
+				expected[key] = true
+				if err := d.options.Store.Write(&store.Record{Key: key, Value: recs[0].Value}); err != nil {
+					return err
+				}
+			}
+		}
+		if (i+1)%100 == 0 {
+			d.options.Logger.Logf("reindex: %v/%v records done", i+1, len(idKeys))
+		}
+	}
+	// sweep keys written by indexes that no longer exist
+	allKeys, err := d.options.Store.List(store.ListPrefix(fmt.Sprintf("%v:", d.options.Namespace)))
+	if err != nil {
+		return err
+	}
+	counterKey := fmt.Sprintf("%v:idCounter", d.options.Namespace)
+	swept := 0
+	for _, key := range allKeys {
+		if strings.HasPrefix(key, idPrefix) || key == counterKey || expected[key] {
+			continue
+		}
+		if err := d.options.Store.Delete(key); err != nil {
+			return err
+		}
+		swept++
+	}
+	d.options.Logger.Logf("reindex: %v records reindexed, %v stale keys removed", len(idKeys), swept)
+	return nil
+}
@@ -0,0 +1,2679 @@
+// Package model provides a simple record store on top of a key value store.
+// Records are saved as JSON and indexed by field so they can be read back
+// with queries, without the model having to know the concrete type.
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micro/website/model/store"
+)
+
+// idFieldName is the default primary key field name.
+const idFieldName = "id"
+
+var (
+	// ErrorNilInterface is returned when a nil value is passed to Save
+	ErrorNilInterface = errors.New("interface to save is nil")
+	// ErrorNotFound is returned by Read when no record matches the query
+	ErrorNotFound = errors.New("not found")
+	// ErrorMultipleRecords is returned by Read when more than one record
+	// matches the query
+	ErrorMultipleRecords = errors.New("multiple records found")
+	// ErrUniqueViolation is returned by Save when a unique index already
+	// holds the value for a different record. Match it with errors.Is, or
+	// use errors.As with *UniqueViolationError to get the field name.
+	ErrUniqueViolation = errors.New("unique index violated")
+	// ErrVersionConflict is returned by Save when optimistic locking is on
+	// and the stored record no longer carries the version the caller read
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrAlreadyExists is returned by Create when a record with the same id
+	// is already present
+	ErrAlreadyExists = errors.New("record already exists")
+)
+
+// UniqueViolationError is the concrete error returned for a unique index
+// conflict. It carries the offending field so callers can report it.
+type UniqueViolationError struct {
+	Field string
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("value of field '%v' must be unique", e.Field)
+}
+
+// FieldName returns the field whose unique index was violated.
+func (e *UniqueViolationError) FieldName() string { return e.Field }
+
+// Is lets errors.Is(err, ErrUniqueViolation) match the concrete error.
+func (e *UniqueViolationError) Is(target error) bool { return target == ErrUniqueViolation }
+
+// ErrNoMatchingIndex is returned by Read, List and their derivatives when no
+// declared index can serve the query. Match it with errors.As to inspect the
+// query type and field that failed to resolve, eg. to map it to a 400.
+type ErrNoMatchingIndex struct {
+	// QueryType is the type of the unserved query, eg. "eq"
+	QueryType string
+	// FieldName is the field the query filters on
+	FieldName string
+}
+
+func (e *ErrNoMatchingIndex) Error() string {
+	return fmt.Sprintf("for query type '%v', field '%v' does not match any indexes", e.QueryType, e.FieldName)
+}
+
+// Model is a set of records with indexes maintained on Save and Delete.
+type Model interface {
+	// Save stores the record and writes all of its index keys.
+	Save(v interface{}, opts ...SaveOption) error
+	// SaveContext is Save bounded by a context. The context is checked
+	// before each store round trip so a slow save can be cancelled.
+	SaveContext(ctx context.Context, v interface{}, opts ...SaveOption) error
+	// SaveWithResult is Save returning the store keys the save wrote and
+	// the stale keys it deleted, eg. for mirroring invalidations to a cache.
+	SaveWithResult(v interface{}, opts ...SaveOption) (*SaveResult, error)
+	// Create saves the record, minting a new id when the id field is empty,
+	// and returns the id the record was stored under. An id already in use
+	// is refused with ErrAlreadyExists.
+	Create(v interface{}) (string, error)
+	// Upsert saves the record like Save and reports whether it was newly
+	// created rather than an overwrite of an existing record.
+	Upsert(v interface{}) (bool, error)
+	// Replace overwrites the existing record with the same id, failing
+	// with ErrorNotFound when there is none.
+	Replace(v interface{}) error
+	// Tx returns a transaction buffering saves and deletes until Commit,
+	// which applies them together or rolls the applied ones back on failure.
+	Tx() *Tx
+	// SaveBatch stores several records in one call. Each record is planned
+	// and written in turn, so unique checks still see the records saved
+	// earlier in the batch. With WithBatchInsertOnly the old entry read is
+	// skipped for every record, which halves the store round trips but
+	// leaves stale index keys behind if a record already existed.
+	SaveBatch(instances ...interface{}) error
+	// Read returns exactly one record matching the query into resultPointer.
+	Read(query Query, resultPointer interface{}) error
+	// ReadContext is Read bounded by a context.
+	ReadContext(ctx context.Context, query Query, resultPointer interface{}) error
+	// ReadByID reads the record with the given id, or ErrorNotFound.
+	ReadByID(id interface{}, resultPointer interface{}) error
+	// ReadMany reads the records with the given ids into resultSlicePointer,
+	// in input order, skipping ids that do not exist.
+	ReadMany(ids []interface{}, resultSlicePointer interface{}) error
+	// First reads the single record at the front of the order the query
+	// would return, or ErrorNotFound when nothing matches.
+	First(query Query, resultPointer interface{}) error
+	// Last reads the single record at the back of the order the query
+	// would return, or ErrorNotFound when nothing matches.
+	Last(query Query, resultPointer interface{}) error
+	// List returns all records matching the query into resultSlicePointer.
+	List(query Query, resultSlicePointer interface{}) error
+	// ListContext is List bounded by a context.
+	ListContext(ctx context.Context, query Query, resultSlicePointer interface{}) error
+	// ListEach streams the raw value of every record matching the query to
+	// fn, one at a time, without materializing the whole result set. An
+	// error returned by fn stops the iteration and is passed back.
+	ListEach(query Query, fn func(raw []byte) error) error
+	// ListWithTotal lists one page of records like List and also returns
+	// the total number of matches ignoring Offset and Limit.
+	ListWithTotal(query Query, resultSlicePointer interface{}) (int64, error)
+	// ListPage returns one page of records matching the query, of at most
+	// query.Limit records, along with an opaque cursor for the next page.
+	// The cursor is empty once all records have been returned.
+	ListPage(query Query, resultSlicePointer interface{}) (string, error)
+	// Count returns the number of records matching the query without
+	// unmarshaling them. A query matching nothing counts zero, not an error.
+	Count(query Query) (int64, error)
+	// Exists returns whether any record matches the query, stopping at the
+	// first match.
+	Exists(query Query) (bool, error)
+	// Sum adds up a numeric field over the records matching the query.
+	Sum(query Query, field string) (float64, error)
+	// Avg averages a numeric field over the records matching the query.
+	Avg(query Query, field string) (float64, error)
+	// Min returns the smallest value of a numeric field over the records
+	// matching the query, or ErrorNotFound when nothing matches.
+	Min(query Query, field string) (float64, error)
+	// Max returns the largest value of a numeric field over the records
+	// matching the query, or ErrorNotFound when nothing matches.
+	Max(query Query, field string) (float64, error)
+	// Distinct returns the unique values of an indexed field in index order.
+	Distinct(field string) ([]interface{}, error)
+	// GroupByCount tallies records per distinct value of an indexed field.
+	// A positive limit caps the number of groups.
+	GroupByCount(field string, limit int64) (map[string]int64, error)
+	// Delete removes the record matching an id equality query.
+	Delete(query Query) error
+	// DeleteContext is Delete bounded by a context.
+	DeleteContext(ctx context.Context, query Query) error
+	// DeleteMany removes every record matching the query, along with all of
+	// their index keys, and returns the number of records deleted. Unlike
+	// Delete it accepts non unique index queries.
+	DeleteMany(query Query) (int64, error)
+	// DeleteAll wipes every key under the model's namespace, across all
+	// indexes. Destructive and irreversible; meant for test teardown and
+	// tenant offboarding.
+	DeleteAll() error
+	// Reindex rebuilds all secondary index keys from the id index, for use
+	// after the index set of a model with existing data has changed.
+	Reindex() error
+	// Verify cross-checks the secondary indexes against the id index and
+	// reports orphaned and missing index keys without modifying anything.
+	Verify() ([]Inconsistency, error)
+	// Repair deletes the orphaned index keys Verify finds and backfills the
+	// missing ones, returning what was repaired.
+	Repair() ([]Inconsistency, error)
+	// Update reads the single record matching the query, merges the changes
+	// over it and saves the result. Fields not named in changes keep their
+	// stored values.
+	Update(query Query, changes map[string]interface{}) error
+	// SoftDelete marks the record matching the query as deleted instead of
+	// removing it. Requires soft deletes to be enabled on the model.
+	SoftDelete(query Query) error
+	// Watch streams change events for records matching the query until the
+	// returned stop function is called.
+	Watch(query Query) (<-chan Event, func(), error)
+	// Explain reports which index would serve the query, the store key
+	// prefix that would be scanned, and whether any index matched at all.
+	Explain(query Query) (Index, string, bool)
+	// KeyForRecord returns the exact store key Save would write for the
+	// record under the given index.
+	KeyForRecord(index Index, record interface{}) (string, error)
+	// DebugKeys returns every store key Save would write for the record,
+	// keyed by index name, without touching the store.
+	DebugKeys(instance interface{}) (map[string]string, error)
+	// PrefixForQuery returns the exact store key prefix List would scan
+	// for the query.
+	PrefixForQuery(query Query) (string, error)
+}
+
+// Codec encodes and decodes the stored record values. The default codec is
+// encoding/json; anything with the same marshal semantics, eg. protobuf,
+// can be plugged in instead.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// numbers decode as json.Number so integer fields past the float64
+	// precision range survive the round trip through the store intact
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// compressMarker and encryptMarker prefix stored record values that were
+// compressed or encrypted on the way in. JSON and other codec output never
+// starts with these bytes, so plain values are unambiguous. A value can carry
+// both: it is compressed first, then encrypted, and unwrapped in reverse.
+const (
+	compressMarker = 0x00
+	encryptMarker  = 0x01
+)
+
+// wrapValue prepares a record value for storage: compression first when it
+// is on, encryption on top when a cipher is configured.
+func (d *db) wrapValue(raw []byte) ([]byte, error) {
+	if d.options.Compress {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(compressMarker)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		raw = buf.Bytes()
+	}
+	if d.options.Cipher != nil {
+		ct, err := d.options.Cipher.Encrypt(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = append([]byte{encryptMarker}, ct...)
+	}
+	return raw, nil
+}
+
+// unwrapValue undoes wrapValue, peeling markers in reverse. Values without a
+// marker pass through, so records written before compression or encryption
+// was enabled keep reading.
+func (d *db) unwrapValue(raw []byte) ([]byte, error) {
+	if len(raw) > 0 && raw[0] == encryptMarker {
+		if d.options.Cipher == nil {
+			return nil, errors.New("record is encrypted and the model has no cipher")
+		}
+		pt, err := d.options.Cipher.Decrypt(raw[1:])
+		if err != nil {
+			return nil, err
+		}
+		raw = pt
+	}
+	if len(raw) == 0 || raw[0] != compressMarker {
+		return raw, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(raw[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// decode unwraps a stored value and decodes it through the codec. Every
+// read path decodes through here so compression stays transparent.
+func (d *db) decode(raw []byte, v interface{}) error {
+	raw, err := d.unwrapValue(raw)
+	if err != nil {
+		return err
+	}
+	return d.options.Codec.Unmarshal(raw, v)
+}
+
+// Metrics receives operation level observations from a model, so callers can
+// export counters and latency histograms without this package importing a
+// metrics library. The op is one of "save", "read", "list" or "delete". The
+// observed duration spans the whole operation including its store round
+// trips, not just the call overhead.
+type Metrics interface {
+	// ObserveOp is invoked once per operation with its duration and outcome
+	ObserveOp(op string, d time.Duration, err error)
+	// ObserveRecords is invoked with the size of each result set
+	ObserveRecords(op string, n int)
+}
+
+// noopMetrics is the default Metrics, observing nothing.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOp(op string, d time.Duration, err error) {}
+func (noopMetrics) ObserveRecords(op string, n int)                 {}
+
+// Logger receives the debug output of a model. Implementations can route it
+// into whatever logging stack the service uses.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Logf(format string, args ...interface{}) {}
+
+// Locker serializes the read-check-write sequence of Save per record.
+// Implementations can back it with a distributed lock so concurrent writers
+// on different nodes cannot interleave their unique checks and old entry
+// reads. The returned unlock releases the lock.
+type Locker interface {
+	Lock(key string) (unlock func(), err error)
+}
+
+type noopLocker struct{}
+
+func (noopLocker) Lock(key string) (func(), error) { return func() {}, nil }
+
+// Options configure a model.
+type Options struct {
+	// Store holds the records and index keys. Defaults to an in memory store.
+	Store store.Store
+	// Codec encodes the stored record values. Defaults to encoding/json.
+	Codec Codec
+	// IDField is the name of the primary key field in the record's JSON
+	// representation. Defaults to "id". The id index, the old entry reads
+	// and the delete paths all key off it.
+	IDField string
+	// Namespace prefixes every key so multiple models can share a store
+	Namespace string
+	// Indexes maintained for the model, in addition to the id index
+	Indexes []Index
+	// Debug logs the keys being written and read
+	Debug bool
+	// Logger receives the debug output. Defaults to a no-op logger.
+	Logger Logger
+	// AutoTimestamps stamps the created at field on first save and the
+	// updated at field on every save, into the stored value itself
+	AutoTimestamps bool
+	// BatchInsertOnly asserts that records passed to SaveBatch are all new
+	// inserts, skipping the per-record old entry read
+	BatchInsertOnly bool
+	// InsertOnly asserts that every record passed to Save is a new insert,
+	// skipping the old entry read and the stale key cleanup that only
+	// updates need. Meant for append-only workloads like event logs; a Save
+	// over an existing record with changed field values leaves its old
+	// secondary index keys behind.
+	InsertOnly bool
+	// Defaults maps top level field names to the value Save fills in when
+	// the record leaves the field absent or zero valued. The defaults are
+	// merged before the index keys are computed, so they are stored and
+	// indexed like explicit values. An explicit non-zero value always wins.
+	Defaults map[string]interface{}
+	// Retry, when set, retries transient store errors with backoff, per
+	// the policy's classifier. Applied around every store call.
+	Retry *Retry
+	// ReverseReads stores index keys in natural ascending form and serves
+	// descending queries by iterating the store backward, instead of the
+	// inverted key encodings. Requires a store with the ReverseReader
+	// capability; see WithReverseReads.
+	ReverseReads bool
+	// Metrics receives an observation per operation and per result set,
+	// eg. for Prometheus counters and histograms. Defaults to a no-op.
+	Metrics Metrics
+	// Tracer opens a span per operation, annotated with the index used, the
+	// key prefix scanned and the record count. Defaults to a no-op.
+	Tracer Tracer
+	// Validate checks records against their `validate` struct tags on Save,
+	// rejecting invalid ones with a ValidationError before anything is
+	// written. Off by default, so the untagged path costs nothing.
+	Validate bool
+	// Compress gzips record values on write. Compressed values carry a
+	// marker byte, so records written before compression was enabled still
+	// read back transparently.
+	Compress bool
+	// Cipher, when set, encrypts record bodies before they are written to
+	// the store and decrypts them transparently on read. Encrypted values
+	// carry a marker byte, so records written before encryption was enabled
+	// still read back. Pair it with Index.Encrypted to keep indexed field
+	// values out of the store keys too.
+	Cipher Cipher
+	// CipherIndexKey keys the deterministic HMAC used by indexes with
+	// Encrypted set. It must stay stable for the lifetime of the data, or
+	// existing index keys stop matching.
+	CipherIndexKey []byte
+	// ReadCacheSize, when positive, keeps an in-memory LRU of that many
+	// records, keyed by id, serving repeated reads of hot records without
+	// a store round trip. Saves and deletes evict the touched id.
+	ReadCacheSize int
+	// IndexByReference makes secondary index keys store only a pointer to
+	// the id key instead of a full copy of the record. Reads through a
+	// secondary index then cost a second store lookup, but a record with
+	// many indexes is stored once rather than once per index.
+	IndexByReference bool
+	// AllowScan lets queries with no matching index fall back to a full
+	// scan of the id index with in memory filtering. Off by default — a
+	// scan reads every record in the namespace.
+	AllowScan bool
+	// AutoID makes Save mint a UUID when the id field is empty, instead of
+	// rejecting the record
+	AutoID bool
+	// AutoIncrement makes Save allocate sequential integer ids from a
+	// counter key in the store when the id field is empty or zero
+	AutoIncrement bool
+	// VersionField enables optimistic locking. Save requires the stored
+	// record to still hold the version the caller read, then increments it.
+	VersionField string
+	// Locker guards the read-check-write sequence of Save per record id.
+	// Defaults to a no-op.
+	Locker Locker
+	// SoftDelete makes SoftDelete mark records instead of removing them,
+	// and Read and List skip marked records unless the query asks for them
+	SoftDelete bool
+	// DeletedField is the boolean field soft deletes set. Defaults to "deleted".
+	DeletedField string
+	// BeforeSave runs inside Save once the old and new record maps are
+	// known, before anything is written. An error aborts the save.
+	BeforeSave func(id string, old, new map[string]interface{}) error
+	// AfterSave runs inside Save after the record and all of its index keys
+	// are fully written
+	AfterSave func(id string, old, new map[string]interface{})
+	// AfterDelete runs after a record and all of its index keys are removed
+	AfterDelete func(id string)
+	// CreatedAtField is the field stamped on first save. Defaults to "createdAt".
+	CreatedAtField string
+	// UpdatedAtField is the field stamped on every save. Defaults to "updatedAt".
+	UpdatedAtField string
+}
+
+// Option sets values in Options.
+type Option func(*Options)
+
+// SaveOptions configure a single Save call.
+type SaveOptions struct {
+	// TTL expires the record after the given duration. Every index key
+	// written for the record carries the same expiry, so they all vanish
+	// together and no dangling secondary key outlives the id key.
+	TTL time.Duration
+	// requireNew makes the save fail with ErrAlreadyExists when a record
+	// with the id is already present. Used by Create.
+	requireNew bool
+	// requireExisting makes the save fail with ErrorNotFound when no record
+	// with the id is present. Used by Replace.
+	requireExisting bool
+}
+
+// SaveOption sets values in SaveOptions.
+type SaveOption func(*SaveOptions)
+
+// withRequireNew makes the save insist the id is unused.
+func withRequireNew() SaveOption {
+	return func(o *SaveOptions) {
+		o.requireNew = true
+	}
+}
+
+// withRequireExisting makes the save insist the id is already in use.
+func withRequireExisting() SaveOption {
+	return func(o *SaveOptions) {
+		o.requireExisting = true
+	}
+}
+
+// WithTTL expires the saved record after ttl. Requires a store that honors
+// write expiry.
+func WithTTL(ttl time.Duration) SaveOption {
+	return func(o *SaveOptions) {
+		o.TTL = ttl
+	}
+}
+
+// WithStore sets the backing store.
+func WithStore(s store.Store) Option {
+	return func(o *Options) {
+		o.Store = s
+	}
+}
+
+// WithCodec sets the codec used for the stored record values.
+func WithCodec(c Codec) Option {
+	return func(o *Options) {
+		o.Codec = c
+	}
+}
+
+// WithIDField sets the name of the primary key field, eg. "_id" or "uuid",
+// when records do not call it "id".
+func WithIDField(name string) Option {
+	return func(o *Options) {
+		o.IDField = name
+	}
+}
+
+// WithNamespace sets the key namespace.
+func WithNamespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+// WithIndexes sets the indexes to maintain.
+func WithIndexes(indexes ...Index) Option {
+	return func(o *Options) {
+		o.Indexes = indexes
+	}
+}
+
+// WithDebug turns on debug logging of keys.
+func WithDebug(debug bool) Option {
+	return func(o *Options) {
+		o.Debug = debug
+	}
+}
+
+// WithLogger sets the logger the debug output goes to.
+func WithLogger(l Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// WithCompression gzips the stored record values, for large compressible
+// documents. Reads handle both compressed and plain values, so it can be
+// enabled on a namespace with existing data.
+func WithCompression() Option {
+	return func(o *Options) {
+		o.Compress = true
+	}
+}
+
+// WithDefaults fills in the given field values on Save when the record
+// leaves them absent or zero valued, eg. a status field defaulting to "new".
+func WithDefaults(defaults map[string]interface{}) Option {
+	return func(o *Options) {
+		o.Defaults = defaults
+	}
+}
+
+// WithRetry retries store calls failing with a transient error, per the
+// given policy. Errors the policy's IsRetryable classifier does not accept
+// fail immediately, as does an exhausted attempt budget.
+func WithRetry(r Retry) Option {
+	return func(o *Options) {
+		o.Retry = &r
+	}
+}
+
+// WithReverseReads serves descending queries by iterating the store backward
+// over keys stored in their natural ascending form, instead of the inverted
+// key encodings the Desc flag otherwise selects. One key format covers both
+// directions, and the inversion math for floats and negative numbers drops
+// out entirely. The Desc flag on indexes is ignored for storage — the
+// requested query direction alone decides the iteration — so enabling this
+// on existing descending indexes orphans their inverted keys until a
+// Reindex. NewModel refuses stores without the store.ReverseReader
+// capability.
+func WithReverseReads() Option {
+	return func(o *Options) {
+		o.ReverseReads = true
+	}
+}
+
+// WithMetrics routes per-operation observations to the given implementation,
+// eg. a Prometheus adapter. The package itself stays free of any metrics
+// dependency.
+func WithMetrics(m Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = m
+	}
+}
+
+// WithTracer opens a span around each operation through the given tracer,
+// eg. an OpenTelemetry adapter, annotated with the index used, the key
+// prefix scanned and the record count, and recording any error.
+func WithTracer(t Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// WithValidation makes Save enforce the `validate` struct tags of the
+// record type — required, min=N, max=N and email — returning a
+// ValidationError naming every offending field.
+func WithValidation() Option {
+	return func(o *Options) {
+		o.Validate = true
+	}
+}
+
+// WithEncryption encrypts record bodies at rest with the given cipher and
+// keys the HMAC digests of encrypted-field indexes with indexKey. Indexes
+// with Encrypted set only serve Equals queries — the digests carry no order,
+// so range, StartsWith and ordered listings over encrypted fields are
+// rejected.
+func WithEncryption(cipher Cipher, indexKey []byte) Option {
+	return func(o *Options) {
+		o.Cipher = cipher
+		o.CipherIndexKey = indexKey
+	}
+}
+
+// WithReadCache keeps an LRU of size recently read records, keyed by id, so
+// hot ReadByID style lookups skip the store. Off by default.
+func WithReadCache(size int) Option {
+	return func(o *Options) {
+		o.ReadCacheSize = size
+	}
+}
+
+// WithIndexByReference stores records once under their id key and keeps only
+// a reference in the secondary index keys, trading a second lookup on reads
+// for much less storage and cheaper writes on large documents.
+func WithIndexByReference() Option {
+	return func(o *Options) {
+		o.IndexByReference = true
+	}
+}
+
+// WithAllowScan permits queries with no matching index to fall back to a
+// full scan. Meant for ad-hoc admin queries; every scan is reported through
+// the logger so a slow query cannot ship silently.
+func WithAllowScan() Option {
+	return func(o *Options) {
+		o.AllowScan = true
+	}
+}
+
+// WithBeforeSave sets a hook that runs before each save writes anything.
+// Returning an error aborts the write, which makes it a natural place for
+// validation or change-data-capture that must not miss a write.
+func WithBeforeSave(hook func(id string, old, new map[string]interface{}) error) Option {
+	return func(o *Options) {
+		o.BeforeSave = hook
+	}
+}
+
+// WithAfterSave sets a hook that runs once a save is fully written, eg. to
+// publish an event or invalidate a cache.
+func WithAfterSave(hook func(id string, old, new map[string]interface{})) Option {
+	return func(o *Options) {
+		o.AfterSave = hook
+	}
+}
+
+// WithAfterDelete sets a hook that runs once a record is fully deleted.
+func WithAfterDelete(hook func(id string)) Option {
+	return func(o *Options) {
+		o.AfterDelete = hook
+	}
+}
+
+// WithSoftDelete makes deletion a marker instead of a removal. Soft deleted
+// records keep all of their index keys — the audit trail stays queryable —
+// and Read and List filter them out after decoding, so scans over an index
+// pay for skipped records but never miss live ones.
+func WithSoftDelete() Option {
+	return func(o *Options) {
+		o.SoftDelete = true
+	}
+}
+
+// WithSoftDeleteField enables soft deletes marked in the named field.
+func WithSoftDeleteField(fieldName string) Option {
+	return func(o *Options) {
+		o.SoftDelete = true
+		o.DeletedField = fieldName
+	}
+}
+
+// WithLocker sets the locker Save acquires around its read-check-write
+// sequence, keyed by record id.
+func WithLocker(l Locker) Option {
+	return func(o *Options) {
+		o.Locker = l
+	}
+}
+
+// WithVersionField turns on optimistic locking using the named numeric
+// field. A Save whose value carries a version older than the stored one
+// fails with ErrVersionConflict, which makes read-modify-write loops safe
+// against concurrent writers.
+func WithVersionField(fieldName string) Option {
+	return func(o *Options) {
+		o.VersionField = fieldName
+	}
+}
+
+// WithAutoID makes Save generate an id for records without one. Use Create
+// to get the generated id back.
+func WithAutoID() Option {
+	return func(o *Options) {
+		o.AutoID = true
+	}
+}
+
+// WithAutoIncrement makes Save allocate sequential integer ids, starting at
+// 1, from a single counter key in the store. Every insert contends on that
+// one key, so this trades insert throughput for human friendly ids; use
+// WithAutoID when inserts need to scale.
+func WithAutoIncrement() Option {
+	return func(o *Options) {
+		o.AutoIncrement = true
+	}
+}
+
+// WithInsertOnly makes every Save skip the read of the record's previous
+// state, for append-only workloads where ids are never reused. Saving an
+// update through it leaves the stale index keys of the old field values in
+// place, so only use it when records are immutable.
+func WithInsertOnly() Option {
+	return func(o *Options) {
+		o.InsertOnly = true
+	}
+}
+
+// WithBatchInsertOnly asserts that batched records are new inserts, so
+// SaveBatch can skip reading back old entries. Only use this when the ids
+// are known not to exist yet.
+func WithBatchInsertOnly() Option {
+	return func(o *Options) {
+		o.BatchInsertOnly = true
+	}
+}
+
+// WithAutoTimestamps turns on automatic created/updated stamping with the
+// default field names.
+func WithAutoTimestamps() Option {
+	return func(o *Options) {
+		o.AutoTimestamps = true
+	}
+}
+
+// WithTimestampFields turns on automatic stamping into the named fields.
+func WithTimestampFields(createdAtField, updatedAtField string) Option {
+	return func(o *Options) {
+		o.AutoTimestamps = true
+		o.CreatedAtField = createdAtField
+		o.UpdatedAtField = updatedAtField
+	}
+}
+
+// idLockShards is the size of the fixed mutex array guarding saves by id.
+const idLockShards = 64
+
+type db struct {
+	options Options
+	idIndex Index
+	// idLocks serialize concurrent saves of the same id within the process,
+	// sharded by a hash of the id so unrelated ids do not contend
+	idLocks [idLockShards]sync.Mutex
+	// watchers subscribed via Watch, guarded by watchersMu
+	watchersMu sync.Mutex
+	watchers   []*watcher
+	// counterMu serializes auto increment id allocation in-process
+	counterMu sync.Mutex
+	// fieldPaths caches the compiled indexed field path resolution per
+	// struct type saved through this model
+	fieldPaths sync.Map
+	// cache is the read-through LRU, nil unless ReadCacheSize is set
+	cache *readCache
+}
+
+// queryIndexError is the error returned when no index can serve a query.
+func queryIndexError(q Query) error {
+	return &ErrNoMatchingIndex{QueryType: q.Type, FieldName: q.FieldName}
+}
+
+// idLock returns the mutex shard for a record id.
+func (d *db) idLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &d.idLocks[h.Sum32()%idLockShards]
+}
+
+// NewModel returns a model with the given options, validating the index
+// definitions up front so misconfigurations surface as an early, actionable
+// error rather than a panic at key encoding time. If no store is configured
+// an in memory store is used.
+func NewModel(opts ...Option) (Model, error) {
+	options := Options{
+		Namespace: "default",
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.Store == nil {
+		options.Store = store.NewMemoryStore()
+	}
+	if options.ReverseReads {
+		// check the capability on the bare store, ahead of the retry wrapper
+		// which would hide it; the ReadDescending option itself passes
+		// through the wrapper untouched
+		if rr, ok := options.Store.(store.ReverseReader); !ok || !rr.ReverseReads() {
+			return nil, errors.New("the store cannot iterate in reverse, required by WithReverseReads")
+		}
+		// keys are stored in natural ascending form either way; clearing the
+		// flags keeps every encoding and read site on the ascending format
+		indexes := make([]Index, len(options.Indexes))
+		copy(indexes, options.Indexes)
+		for j := range indexes {
+			indexes[j].Desc = false
+		}
+		options.Indexes = indexes
+	}
+	if options.Retry != nil && options.Retry.Attempts > 1 {
+		options.Store = &retryStore{Store: options.Store, retry: *options.Retry}
+	}
+	if options.Codec == nil {
+		options.Codec = jsonCodec{}
+	}
+	if options.Logger == nil {
+		options.Logger = noopLogger{}
+	}
+	if options.Locker == nil {
+		options.Locker = noopLocker{}
+	}
+	if options.Metrics == nil {
+		options.Metrics = noopMetrics{}
+	}
+	if options.Tracer == nil {
+		options.Tracer = noopTracer{}
+	}
+	if options.IDField == "" {
+		options.IDField = idFieldName
+	}
+	if options.CreatedAtField == "" {
+		options.CreatedAtField = "createdAt"
+	}
+	if options.UpdatedAtField == "" {
+		options.UpdatedAtField = "updatedAt"
+	}
+	if options.DeletedField == "" {
+		options.DeletedField = "deleted"
+	}
+	for _, idx := range options.Indexes {
+		if err := validateIndex(idx); err != nil {
+			return nil, err
+		}
+		if idx.Encrypted && len(options.CipherIndexKey) == 0 {
+			return nil, fmt.Errorf("encrypted index on '%v' requires a cipher index key, see WithEncryption", idx.FieldName)
+		}
+	}
+	// two indexes deriving the same key segment for different fields would
+	// silently share an index namespace and corrupt both
+	names := map[string]string{}
+	for _, idx := range append([]Index{ByEquality(options.IDField)}, options.Indexes...) {
+		name := indexName(idx)
+		if existing, ok := names[name]; ok && existing != idx.FieldName {
+			return nil, fmt.Errorf("indexes on '%v' and '%v' both map to the key name '%v'; set KeyName on one to keep them apart", existing, idx.FieldName, name)
+		}
+		names[name] = idx.FieldName
+	}
+	d := &db{
+		options: options,
+		idIndex: ByEquality(options.IDField),
+	}
+	if options.ReadCacheSize > 0 {
+		d.cache = newReadCache(options.ReadCacheSize)
+	}
+	return d, nil
+}
+
+// validateIndex checks a single index definition for consistency.
+func validateIndex(i Index) error {
+	if i.FieldName == "" {
+		return errors.New("index has an empty field name")
+	}
+	for _, fn := range i.FieldNames {
+		if fn == "" {
+			return fmt.Errorf("index on '%v' has an empty component field name", i.FieldName)
+		}
+	}
+	if i.Type != indexTypeEq {
+		return fmt.Errorf("index on '%v' has unknown type '%v'", i.FieldName, i.Type)
+	}
+	if i.Ordered && i.StringOrderPadLength <= 0 {
+		return fmt.Errorf("ordered index on '%v' requires a positive StringOrderPadLength", i.FieldName)
+	}
+	return nil
+}
+
+// isZeroValue reports whether a decoded field value counts as unset for the
+// purposes of default injection. It sees the types a json decode produces,
+// plus time.Time from the reflection fast path.
+func isZeroValue(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case string:
+		return t == ""
+	case bool:
+		return !t
+	case json.Number:
+		f, err := t.Float64()
+		return err == nil && f == 0
+	case float64:
+		return t == 0
+	case int64:
+		return t == 0
+	case uint64:
+		return t == 0
+	case time.Time:
+		return t.IsZero()
+	}
+	return false
+}
+
+// debugf logs through the configured logger when Debug is on.
+func (d *db) debugf(format string, args ...interface{}) {
+	if !d.options.Debug {
+		return
+	}
+	d.options.Logger.Logf(format, args...)
+}
+
+// allIndexes returns the id index followed by the configured indexes.
+func (d *db) allIndexes() []Index {
+	return append([]Index{d.idIndex}, d.options.Indexes...)
+}
+
+func (d *db) Save(v interface{}, opts ...SaveOption) error {
+	return d.SaveContext(context.Background(), v, opts...)
+}
+
+func (d *db) SaveContext(ctx context.Context, v interface{}, opts ...SaveOption) error {
+	start := time.Now()
+	ctx, span := d.startSpan(ctx, "model.Save")
+	_, err := d.saveContext(ctx, v, false, opts...)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	d.options.Metrics.ObserveOp("save", time.Since(start), err)
+	return err
+}
+
+// SaveResult reports the store keys a save touched.
+type SaveResult struct {
+	// WrittenKeys are the keys the record was stored under, the id key and
+	// one per index entry
+	WrittenKeys []string
+	// DeletedKeys are the stale index keys of the previous record state
+	// that the save removed
+	DeletedKeys []string
+	// Created reports that no previous record existed under the id. Saves
+	// that skip the old entry read, eg. insert-only ones, always report it.
+	Created bool
+}
+
+// SaveWithResult saves the record like Save and returns which keys were
+// written and which stale keys were deleted. The bookkeeping exists anyway;
+// this just hands it back instead of discarding it.
+func (d *db) SaveWithResult(v interface{}, opts ...SaveOption) (*SaveResult, error) {
+	return d.saveContext(context.Background(), v, false, opts...)
+}
+
+// mintID fills the id field of a decoded record when it is empty, either
+// from the auto increment counter or with a fresh UUID. It reports whether
+// the map was changed.
+func (d *db) mintID(m map[string]interface{}) (bool, error) {
+	existing, ok := m[d.options.IDField]
+	empty := !ok || existing == nil || existing == ""
+	if d.options.AutoIncrement && ok && fmt.Sprintf("%v", existing) == "0" {
+		// a zero integer id counts as unset, the counter starts at 1
+		empty = true
+	}
+	if !empty {
+		return false, nil
+	}
+	if d.options.AutoIncrement {
+		n, err := d.nextSequence()
+		if err != nil {
+			return false, err
+		}
+		m[d.options.IDField] = n
+		return true, nil
+	}
+	id, err := newID()
+	if err != nil {
+		return false, err
+	}
+	m[d.options.IDField] = id
+	return true, nil
+}
+
+// nextSequence allocates the next auto increment id. The counter lives under
+// a single key in the store and the read-increment-write runs under both the
+// process mutex and the configured locker, so concurrent inserts never share
+// an id — at the cost of serializing on the counter.
+func (d *db) nextSequence() (int64, error) {
+	d.counterMu.Lock()
+	defer d.counterMu.Unlock()
+	key := fmt.Sprintf("%v:idCounter", d.options.Namespace)
+	unlock, err := d.options.Locker.Lock(key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	var n int64
+	recs, err := d.options.Store.Read(key)
+	if err != nil && err != store.ErrNotFound {
+		return 0, err
+	}
+	if err == nil && len(recs) > 0 {
+		if n, err = strconv.ParseInt(string(recs[0].Value), 10, 64); err != nil {
+			return 0, fmt.Errorf("corrupt id counter: %v", err)
+		}
+	}
+	n++
+	record := &store.Record{Key: key, Value: []byte(strconv.FormatInt(n, 10))}
+	if err := d.options.Store.Write(record); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// newID mints a random v4 UUID for records saved without an id.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Create saves the record and returns the id it was stored under, minting
+// one when the id field is empty. Unlike Save with AutoID the generated id
+// is handed back to the caller. A record whose id is already taken is
+// refused with ErrAlreadyExists instead of silently overwritten; Save and
+// Upsert keep the overwrite semantics.
+func (d *db) Create(v interface{}) (string, error) {
+	if v == nil {
+		return "", ErrorNilInterface
+	}
+	js, err := d.options.Codec.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	m := map[string]interface{}{}
+	if err := d.decode(js, &m); err != nil {
+		return "", err
+	}
+	if _, err := d.mintID(m); err != nil {
+		return "", err
+	}
+	if _, err := d.saveContext(context.Background(), m, false, withRequireNew()); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", m[d.options.IDField]), nil
+}
+
+// Replace overwrites the existing record with the same id, failing with
+// ErrorNotFound when there is none, for PUT style "update existing"
+// semantics. A successful replace cleans up the stale secondary keys of the
+// previous state exactly like Save.
+func (d *db) Replace(v interface{}) error {
+	_, err := d.saveContext(context.Background(), v, false, withRequireExisting())
+	return err
+}
+
+// Upsert saves the record like Save and reports whether it was newly
+// created rather than an overwrite of an existing record, so eg. an API
+// handler can answer 201 or 200 accordingly. Save reads the previous state
+// of the record anyway; this just surfaces what the read found.
+func (d *db) Upsert(v interface{}) (bool, error) {
+	res, err := d.saveContext(context.Background(), v, false)
+	if err != nil {
+		return false, err
+	}
+	return res.Created, nil
+}
+
+// SaveBatch saves all the given records in order. Without a multi-write API
+// on the store each record still takes its own writes, but the old entry
+// reads can be skipped wholesale with WithBatchInsertOnly.
+func (d *db) SaveBatch(instances ...interface{}) error {
+	ctx := context.Background()
+	for _, v := range instances {
+		if _, err := d.saveContext(ctx, v, d.options.BatchInsertOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveContext implements Save. With skipOldEntry the read back of the
+// existing record is skipped, so no stale index keys are cleaned up.
+func (d *db) saveContext(ctx context.Context, v interface{}, skipOldEntry bool, opts ...SaveOption) (*SaveResult, error) {
+	if v == nil {
+		return nil, ErrorNilInterface
+	}
+	var saveOptions SaveOptions
+	for _, o := range opts {
+		o(&saveOptions)
+	}
+	// every key of the record shares the same write options, in particular
+	// the same expiry
+	writeOpts := []store.WriteOption{}
+	if saveOptions.TTL > 0 {
+		writeOpts = append(writeOpts, store.WriteTTL(saveOptions.TTL))
+	}
+	if d.options.Validate {
+		if err := validateStruct(v); err != nil {
+			return nil, err
+		}
+	}
+	js, err := d.options.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// read the indexed fields off the struct by reflection where possible,
+	// falling back to decoding the marshaled record for maps and types the
+	// key encoders do not understand
+	paths := []string{d.options.IDField}
+	for _, idx := range d.options.Indexes {
+		if len(idx.FieldNames) > 1 {
+			paths = append(paths, idx.FieldNames...)
+			continue
+		}
+		paths = append(paths, idx.FieldName)
+		if idx.OrderFieldName != "" && idx.OrderFieldName != idx.FieldName {
+			paths = append(paths, idx.OrderFieldName)
+		}
+	}
+	m, ok := d.fieldValues(v, paths)
+	if d.options.AutoTimestamps || d.options.VersionField != "" ||
+		d.options.BeforeSave != nil || d.options.AfterSave != nil ||
+		d.options.AutoID || d.options.AutoIncrement ||
+		len(d.options.Defaults) > 0 || d.hasWatchers() {
+		// injected fields end up in the stored value, and hooks and watch
+		// events see the full record, so the whole map is needed, not just
+		// the indexed fields
+		ok = false
+	}
+	if !ok {
+		m = map[string]interface{}{}
+		if err := d.decode(js, &m); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.options.Defaults) > 0 {
+		applied := false
+		for field, value := range d.options.Defaults {
+			if existing, ok := m[field]; ok && !isZeroValue(existing) {
+				continue
+			}
+			m[field] = value
+			applied = true
+		}
+		if applied {
+			// the defaults go into the stored value too, so re-marshal
+			if js, err = d.options.Codec.Marshal(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.options.AutoID || d.options.AutoIncrement {
+		minted, err := d.mintID(m)
+		if err != nil {
+			return nil, err
+		}
+		if minted {
+			// the id has to end up in the stored value too, so re-marshal
+			if js, err = d.options.Codec.Marshal(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	idValue, ok := m[d.options.IDField]
+	if !ok {
+		return nil, fmt.Errorf("a value with a non empty '%v' field is required", d.options.IDField)
+	}
+	id := fmt.Sprintf("%v", idValue)
+	idKey, err := d.indexToKey(ctx, d.idIndex, id, idValue, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// serialize saves of the same id within the process so the read-back
+	// and unique checks of two goroutines cannot interleave
+	mu := d.idLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// hold the per record lock across the read-check-write sequence so two
+	// saves of the same id cannot interleave across processes
+	unlock, err := d.options.Locker.Lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// read the old entry, if any, so index keys belonging to stale field
+	// values can be removed
+	var oldEntry map[string]interface{}
+	var oldRecords []*store.Record
+	if (!skipOldEntry && !d.options.InsertOnly) || saveOptions.requireNew || saveOptions.requireExisting {
+		oldRecords, err = d.options.Store.Read(idKey)
+		if err != nil && err != store.ErrNotFound {
+			return nil, err
+		}
+		if err == nil && len(oldRecords) > 0 {
+			oldEntry = map[string]interface{}{}
+			if err := d.decode(oldRecords[0].Value, &oldEntry); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if saveOptions.requireNew && oldEntry != nil {
+		return nil, ErrAlreadyExists
+	}
+	if saveOptions.requireExisting && oldEntry == nil {
+		return nil, ErrorNotFound
+	}
+
+	if vf := d.options.VersionField; vf != "" {
+		// the save only goes through if the caller's version matches the
+		// stored one, then the stored version moves one past it
+		current := toInt64(m[vf])
+		if oldEntry != nil && toInt64(oldEntry[vf]) != current {
+			return nil, ErrVersionConflict
+		}
+		m[vf] = current + 1
+	}
+	if d.options.AutoTimestamps {
+		// stamp the timestamps into the record. The created at value is
+		// kept from the old entry on updates.
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		m[d.options.CreatedAtField] = now
+		if oldEntry != nil {
+			if created, ok := oldEntry[d.options.CreatedAtField]; ok {
+				m[d.options.CreatedAtField] = created
+			}
+		}
+		m[d.options.UpdatedAtField] = now
+	}
+	if d.options.AutoTimestamps || d.options.VersionField != "" {
+		// re-marshal so the stored value carries the injected fields, not
+		// just the index keys
+		if js, err = d.options.Codec.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.options.BeforeSave != nil {
+		if err := d.options.BeforeSave(id, oldEntry, m); err != nil {
+			return nil, err
+		}
+	}
+
+	// plan all the key changes before touching the store, so an encoding
+	// error cannot leave the record half indexed
+	newKeys := make([]string, 0, len(d.options.Indexes))
+	oldKeys := make([]string, 0, len(d.options.Indexes))
+	for _, idx := range d.options.Indexes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		newValue, err := indexFieldValue(idx, m)
+		if err != nil {
+			return nil, err
+		}
+		newValues, err := indexValues(idx, newValue)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, value := range newValues {
+			if idx.Unique {
+				prefix, err := d.indexToKey(ctx, idx, id, value, false)
+				if err != nil {
+					return nil, err
+				}
+				recs, err := d.options.Store.Read(prefix, store.ReadPrefix())
+				if err != nil && err != store.ErrNotFound {
+					return nil, err
+				}
+				for _, rec := range recs {
+					if !strings.HasSuffix(rec.Key, ":"+encodeIDPart(id)) {
+						return nil, &UniqueViolationError{Field: idx.FieldName}
+					}
+				}
+			}
+
+			newKey, err := d.indexToKey(ctx, idx, id, value, true)
+			if err != nil {
+				return nil, err
+			}
+			newKeys = append(newKeys, newKey)
+		}
+
+		if oldEntry != nil {
+			oldValue, err := indexFieldValue(idx, oldEntry)
+			if err != nil {
+				return nil, err
+			}
+			oldValues, err := indexValues(idx, oldValue)
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range oldValues {
+				oldKey, err := d.indexToKey(ctx, idx, id, value, true)
+				if err != nil {
+					return nil, err
+				}
+				oldKeys = append(oldKeys, oldKey)
+			}
+		}
+	}
+
+	// write the new keys, undoing everything written so far if the store
+	// fails part way so no partially indexed record remains
+	var oldRaw []byte
+	if len(oldRecords) > 0 {
+		oldRaw = oldRecords[0].Value
+	}
+	written := []string{}
+	rollback := func(cause error) (*SaveResult, error) {
+		for _, k := range written {
+			d.options.Store.Delete(k)
+		}
+		if oldRaw != nil {
+			// put the previous entry back under all of its keys
+			oldIndexValue := oldRaw
+			if d.options.IndexByReference {
+				oldIndexValue = []byte(idKey)
+			}
+			for _, k := range oldKeys {
+				d.options.Store.Write(&store.Record{Key: k, Value: oldIndexValue})
+			}
+			d.options.Store.Write(&store.Record{Key: idKey, Value: oldRaw})
+		}
+		return nil, cause
+	}
+
+	stored, err := d.wrapValue(js)
+	if err != nil {
+		return nil, err
+	}
+	// with reference indexes the secondary keys carry only the id key of
+	// the record, the body lives under the id key alone
+	indexValue := stored
+	if d.options.IndexByReference {
+		indexValue = []byte(idKey)
+	}
+	for _, k := range newKeys {
+		if err := ctx.Err(); err != nil {
+			return rollback(err)
+		}
+		d.debugf("saving key '%v'", k)
+		if err := d.options.Store.Write(&store.Record{Key: k, Value: indexValue}, writeOpts...); err != nil {
+			return rollback(err)
+		}
+		written = append(written, k)
+	}
+
+	span := spanFromContext(ctx)
+	span.SetAttribute("index", indexName(d.idIndex))
+	span.SetAttribute("key", idKey)
+	d.debugf("saving key '%v'", idKey)
+	if err := d.options.Store.Write(&store.Record{Key: idKey, Value: stored}, writeOpts...); err != nil {
+		return rollback(err)
+	}
+
+	// the record is fully written, now drop the keys of stale field values
+	deleted := []string{}
+	for _, oldKey := range oldKeys {
+		stale := true
+		for _, k := range newKeys {
+			if k == oldKey {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			if err := d.options.Store.Delete(oldKey); err != nil {
+				return nil, err
+			}
+			deleted = append(deleted, oldKey)
+		}
+	}
+	if d.cache != nil {
+		d.cache.evict(fmt.Sprintf("%v:%v", d.namespace(ctx), id))
+	}
+	if d.options.AfterSave != nil {
+		d.options.AfterSave(id, oldEntry, m)
+	}
+	eventType := EventUpdate
+	if oldEntry == nil {
+		eventType = EventCreate
+	}
+	d.notify(eventType, id, m)
+	return &SaveResult{
+		WrittenKeys: append(written, idKey),
+		DeletedKeys: deleted,
+		Created:     oldEntry == nil,
+	}, nil
+}
+
+func (d *db) Read(query Query, resultPointer interface{}) error {
+	return d.ReadContext(context.Background(), query, resultPointer)
+}
+
+func (d *db) ReadContext(ctx context.Context, query Query, resultPointer interface{}) error {
+	start := time.Now()
+	ctx, span := d.startSpan(ctx, "model.Read")
+	err := d.readContext(ctx, query, resultPointer)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	d.options.Metrics.ObserveOp("read", time.Since(start), err)
+	if err == nil {
+		d.options.Metrics.ObserveRecords("read", 1)
+	}
+	return err
+}
+
+func (d *db) readContext(ctx context.Context, query Query, resultPointer interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// id reads can be served straight out of the LRU. Soft delete models
+	// skip it — the deleted filtering happens on decoded records.
+	cacheID := ""
+	if d.cache != nil && !d.options.SoftDelete &&
+		query.Type == queryTypeEq && query.FieldName == d.options.IDField {
+		// the namespace qualifies the cache key so tenants never share
+		// cached entries
+		cacheID = fmt.Sprintf("%v:%v", d.namespace(ctx), query.Value)
+		if raw, ok := d.cache.get(cacheID); ok {
+			d.debugf("read cache hit for id '%v'", cacheID)
+			return d.decode(raw, resultPointer)
+		}
+	}
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if query.Type != queryTypeEq {
+			// range, exclusion and prefix queries filter on the scanned
+			// keys; the equality prefix read below would treat the boundary
+			// value as the match itself
+			recs, err := d.listRecordsContext(ctx, idx, query)
+			if err != nil {
+				return err
+			}
+			if len(recs) == 0 {
+				return ErrorNotFound
+			}
+			if len(recs) > 1 {
+				return ErrorMultipleRecords
+			}
+			return d.decode(recs[0].Value, resultPointer)
+		}
+		k, err := d.queryToListKey(ctx, idx, query)
+		if err != nil {
+			return err
+		}
+		span := spanFromContext(ctx)
+		span.SetAttribute("index", indexName(idx))
+		span.SetAttribute("prefix", k)
+		d.debugf("reading key '%v'", k)
+		// two records are enough to tell "exactly one" from "multiple", so
+		// a hot prefix is never materialized wholesale. Soft deleted records
+		// are filtered after the read, so there the read stays unbounded.
+		opts := []store.ReadOption{store.ReadPrefix()}
+		if !d.options.SoftDelete {
+			opts = append(opts, store.ReadLimit(2))
+		}
+		recs, err := d.options.Store.Read(k, opts...)
+		if err != nil {
+			return err
+		}
+		if recs, err = d.dereference(idx, recs); err != nil {
+			return err
+		}
+		if recs, err = d.filterDeleted(recs, query); err != nil {
+			return err
+		}
+		span.SetAttribute("records", len(recs))
+		if len(recs) == 0 {
+			return ErrorNotFound
+		}
+		if len(recs) > 1 {
+			return ErrorMultipleRecords
+		}
+		if cacheID != "" {
+			d.cache.set(cacheID, recs[0].Value)
+		}
+		return d.decode(recs[0].Value, resultPointer)
+	}
+	if d.options.AllowScan {
+		recs, err := d.scanRecords(ctx, query)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return ErrorNotFound
+		}
+		if len(recs) > 1 {
+			return ErrorMultipleRecords
+		}
+		return d.decode(recs[0].Value, resultPointer)
+	}
+	return queryIndexError(query)
+}
+
+// ReadByID reads the record with the given id through the id index. It spares
+// callers spelling out the equality query and, with it, getting the id field
+// name wrong — the query is built from the field the id index is configured
+// on. Returns ErrorNotFound when no record has the id.
+func (d *db) ReadByID(id interface{}, resultPointer interface{}) error {
+	return d.Read(Equals(d.idIndex.FieldName, id), resultPointer)
+}
+
+// ReadMany reads many records by id in one call, eg. to hydrate a list of
+// foreign keys. Results come back in the order of the ids; ids without a
+// record are skipped rather than an error, so the result can be shorter than
+// the input. Each id still costs one store read — the store has no multi
+// read — but the index matching and query plumbing run only once.
+func (d *db) ReadMany(ids []interface{}, resultSlicePointer interface{}) error {
+	recs := make([]*store.Record, 0, len(ids))
+	for _, id := range ids {
+		key, err := d.indexToKey(context.Background(), d.idIndex, fmt.Sprintf("%v", id), id, true)
+		if err != nil {
+			return err
+		}
+		read, err := d.options.Store.Read(key)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		recs = append(recs, read...)
+	}
+	recs, err := d.filterDeleted(recs, Query{})
+	if err != nil {
+		return err
+	}
+	return d.unmarshalRecords(recs, resultSlicePointer)
+}
+
+// First reads exactly one record from the front of the order the query would
+// return, eg. the cheapest product off an ascending price index. Equality
+// queries read a single record from the store rather than pulling the prefix
+// and taking the head; when the front of the requested order sits at the
+// physical end of the keys, only the last key of the prefix is read.
+func (d *db) First(query Query, resultPointer interface{}) error {
+	query.Offset = 0
+	query.Limit = 1
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if query.Type == queryTypeEq && !d.options.SoftDelete && query.Desc != idx.Desc {
+			// the requested order is the reverse of the physical one, so the
+			// first record lives under the last key of the prefix
+			return d.readEdgeRecord(idx, query, resultPointer)
+		}
+		recs, err := d.listRecords(idx, query)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return ErrorNotFound
+		}
+		return d.decode(recs[0].Value, resultPointer)
+	}
+	return queryIndexError(query)
+}
+
+// Last is First at the other end of the requested order, eg. the most
+// expensive product off the same ascending price index.
+func (d *db) Last(query Query, resultPointer interface{}) error {
+	query.Desc = !query.Desc
+	return d.First(query, resultPointer)
+}
+
+// readEdgeRecord reads the record under the last key of the prefix a query
+// scans, without materializing the records in between.
+func (d *db) readEdgeRecord(i Index, q Query, resultPointer interface{}) error {
+	k, err := d.queryToListKey(context.Background(), i, q)
+	if err != nil {
+		return err
+	}
+	if d.options.ReverseReads {
+		// the store hands over the last key of the prefix directly, without
+		// listing the keys in between
+		recs, err := d.options.Store.Read(k, store.ReadPrefix(), store.ReadDescending(), store.ReadLimit(1))
+		if err == store.ErrNotFound {
+			return ErrorNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if recs, err = d.dereference(i, recs); err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return ErrorNotFound
+		}
+		return d.decode(recs[0].Value, resultPointer)
+	}
+	keys, err := d.options.Store.List(store.ListPrefix(k))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrorNotFound
+	}
+	recs, err := d.options.Store.Read(keys[len(keys)-1])
+	if err == store.ErrNotFound {
+		return ErrorNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if recs, err = d.dereference(i, recs); err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return ErrorNotFound
+	}
+	return d.decode(recs[0].Value, resultPointer)
+}
+
+func (d *db) List(query Query, resultSlicePointer interface{}) error {
+	return d.ListContext(context.Background(), query, resultSlicePointer)
+}
+
+func (d *db) ListContext(ctx context.Context, query Query, resultSlicePointer interface{}) error {
+	start := time.Now()
+	ctx, span := d.startSpan(ctx, "model.List")
+	err := d.listContext(ctx, query, resultSlicePointer)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	d.options.Metrics.ObserveOp("list", time.Since(start), err)
+	return err
+}
+
+func (d *db) listContext(ctx context.Context, query Query, resultSlicePointer interface{}) error {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		recs, err := d.listRecordsContext(ctx, idx, query)
+		if err != nil {
+			return err
+		}
+		d.options.Metrics.ObserveRecords("list", len(recs))
+		return d.unmarshalRecords(recs, resultSlicePointer)
+	}
+	if d.options.AllowScan {
+		recs, err := d.scanRecords(ctx, query)
+		if err != nil {
+			return err
+		}
+		d.options.Metrics.ObserveRecords("list", len(recs))
+		return d.unmarshalRecords(recs, resultSlicePointer)
+	}
+	return queryIndexError(query)
+}
+
+// ListWithTotal lists one page of records and counts every match of the
+// query in the same call, for "page 2 of 17" style pagination. The page
+// honors Offset and Limit; the total ignores both and is counted off the
+// index keys, so the bodies outside the page are never unmarshaled.
+func (d *db) ListWithTotal(query Query, resultSlicePointer interface{}) (int64, error) {
+	if err := d.List(query, resultSlicePointer); err != nil {
+		return 0, err
+	}
+	total := query
+	total.Offset, total.Limit = 0, 0
+	return d.Count(total)
+}
+
+// listEachBatch is the store read size ListEach pages through a prefix with.
+const listEachBatch = 100
+
+// ListEach streams matching records to fn as raw stored values, decoded by
+// the caller, so exporting a large index never builds one giant slice.
+// Equality queries page through the store in fixed size batches; queries
+// that filter in memory fall back to a single scan. A non-nil error from fn
+// stops the iteration and is returned as is.
+func (d *db) ListEach(query Query, fn func(raw []byte) error) error {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if query.Type != queryTypeEq || d.options.SoftDelete || query.Desc != idx.Desc {
+			// the in memory filtering and reversing paths need the full set
+			// anyway
+			recs, err := d.listRecords(idx, query)
+			if err != nil {
+				return err
+			}
+			for _, rec := range recs {
+				raw, err := d.unwrapValue(rec.Value)
+				if err != nil {
+					return err
+				}
+				if err := fn(raw); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		k, err := d.queryToListKey(context.Background(), idx, query)
+		if err != nil {
+			return err
+		}
+		offset := uint(query.Offset)
+		remaining := query.Limit
+		for {
+			limit := uint(listEachBatch)
+			if remaining > 0 && remaining < int64(limit) {
+				limit = uint(remaining)
+			}
+			recs, err := d.options.Store.Read(k, store.ReadPrefix(), store.ReadOffset(offset), store.ReadLimit(limit))
+			if err != nil {
+				return err
+			}
+			deref, err := d.dereference(idx, recs)
+			if err != nil {
+				return err
+			}
+			for _, rec := range deref {
+				raw, err := d.unwrapValue(rec.Value)
+				if err != nil {
+					return err
+				}
+				if err := fn(raw); err != nil {
+					return err
+				}
+			}
+			offset += uint(len(recs))
+			if remaining > 0 {
+				remaining -= int64(len(recs))
+				if remaining <= 0 {
+					return nil
+				}
+			}
+			if uint(len(recs)) < limit {
+				return nil
+			}
+		}
+	}
+	return queryIndexError(query)
+}
+
+// ListPage lists one page of records and returns the cursor for the next
+// page. The cursor is the base64 of the last index key seen so it survives a
+// round trip through a URL.
+func (d *db) ListPage(query Query, resultSlicePointer interface{}) (string, error) {
+	var lastKey string
+	if query.Cursor != "" {
+		b, err := base64.URLEncoding.DecodeString(query.Cursor)
+		if err != nil {
+			return "", fmt.Errorf("invalid cursor: %v", err)
+		}
+		lastKey = string(b)
+	}
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		// the records of a page come back in the requested order; their keys
+		// run ascending when that order matches the physical one of the
+		// index and descending when it opposes it, which flips the cursor
+		// comparisons below
+		descKeys := query.Desc != idx.Desc
+		if query.Type == queryTypeEq && !d.options.SoftDelete {
+			return d.listPageKeys(idx, query, lastKey, descKeys, resultSlicePointer)
+		}
+		// queries that filter on the decoded records need the full set; the
+		// cursor position is found by search rather than element-wise strip
+		full := query
+		full.Offset, full.Limit, full.Cursor = 0, 0, ""
+		recs, err := d.listRecords(idx, full)
+		if err != nil {
+			return "", err
+		}
+		if lastKey != "" {
+			pos := sort.Search(len(recs), func(j int) bool {
+				if descKeys {
+					return recs[j].Key < lastKey
+				}
+				return recs[j].Key > lastKey
+			})
+			recs = recs[pos:]
+		}
+		next := ""
+		if query.Limit > 0 && int64(len(recs)) > query.Limit {
+			recs = recs[:query.Limit]
+			next = base64.URLEncoding.EncodeToString([]byte(recs[len(recs)-1].Key))
+		}
+		return next, d.unmarshalRecords(recs, resultSlicePointer)
+	}
+	return "", queryIndexError(query)
+}
+
+// listPageKeys serves a cursor page off the index keys alone: the key list
+// locates the cursor position, and only the page's record bodies are read,
+// so the cost of a page stays proportional to its size rather than to the
+// offset the cursor has advanced to.
+func (d *db) listPageKeys(i Index, q Query, lastKey string, descKeys bool, resultSlicePointer interface{}) (string, error) {
+	k, err := d.queryToListKey(context.Background(), i, q)
+	if err != nil {
+		return "", err
+	}
+	keys, err := d.options.Store.List(store.ListPrefix(k))
+	if err != nil {
+		return "", err
+	}
+	if descKeys {
+		for a, b := 0, len(keys)-1; a < b; a, b = a+1, b-1 {
+			keys[a], keys[b] = keys[b], keys[a]
+		}
+	}
+	if lastKey != "" {
+		pos := sort.Search(len(keys), func(j int) bool {
+			if descKeys {
+				return keys[j] < lastKey
+			}
+			return keys[j] > lastKey
+		})
+		keys = keys[pos:]
+	}
+	next := ""
+	if q.Limit > 0 && int64(len(keys)) > q.Limit {
+		keys = keys[:q.Limit]
+		next = base64.URLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+	recs := make([]*store.Record, 0, len(keys))
+	for _, key := range keys {
+		read, err := d.options.Store.Read(key)
+		if err == store.ErrNotFound {
+			// the record vanished between the key list and the read
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		recs = append(recs, read...)
+	}
+	if recs, err = d.dereference(i, recs); err != nil {
+		return "", err
+	}
+	return next, d.unmarshalRecords(recs, resultSlicePointer)
+}
+
+// Explain resolves a query the same way Read and List do and reports the
+// outcome instead of running it: the first matching index, the store key
+// prefix the query would scan, and whether a match exists at all. When no
+// index matches, the zero Index and false explain the opaque query error.
+func (d *db) Explain(query Query) (Index, string, bool) {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		var prefix string
+		switch query.Type {
+		case queryTypeGt, queryTypeLt, queryTypeBetween:
+			// range queries scan the whole index and filter on the encoded keys
+			prefix = fmt.Sprintf("%v:%v:", d.options.Namespace, indexName(idx))
+		case queryTypeStartsWith:
+			if term, ok := query.Value.(string); ok {
+				prefix = fmt.Sprintf("%v:%v:%v", d.options.Namespace, indexName(idx), escapeKeyPart(d.getOrderedStringPrefixKey(idx, term)))
+			}
+		default:
+			// an encoding error leaves the prefix empty, the match still counts
+			prefix, _ = d.queryToListKey(context.Background(), idx, query)
+		}
+		return idx, prefix, true
+	}
+	return Index{}, "", false
+}
+
+// KeyForRecord computes the store key Save would write for the record under
+// the given index, eg. for migration or repair scripts that need to match
+// the package's encoding exactly. Multi value indexes write one key per
+// element and are not supported here.
+func (d *db) KeyForRecord(index Index, record interface{}) (string, error) {
+	if index.MultiValue {
+		return "", fmt.Errorf("index on '%v' writes one key per element, there is no single record key", index.FieldName)
+	}
+	js, err := d.options.Codec.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	m := map[string]interface{}{}
+	if err := d.decode(js, &m); err != nil {
+		return "", err
+	}
+	idValue, ok := m[d.options.IDField]
+	if !ok {
+		return "", fmt.Errorf("record has no '%v' field", d.options.IDField)
+	}
+	value, err := indexFieldValue(index, m)
+	if err != nil {
+		return "", err
+	}
+	return d.indexToKey(context.Background(), index, fmt.Sprintf("%v", idValue), value, true)
+}
+
+// DebugKeys computes the store keys Save would write for the record across
+// every index, including the id index, without touching the store — a pure
+// inspection for tests and tooling asserting on the key layout. The result
+// maps index name to key; a multi value index contributes one entry per
+// element, suffixed with the element position, and an index whose field is
+// nil contributes nothing, matching what Save would write.
+func (d *db) DebugKeys(instance interface{}) (map[string]string, error) {
+	js, err := d.options.Codec.Marshal(instance)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := d.decode(js, &m); err != nil {
+		return nil, err
+	}
+	idValue, ok := m[d.options.IDField]
+	if !ok {
+		return nil, fmt.Errorf("record has no '%v' field", d.options.IDField)
+	}
+	id := fmt.Sprintf("%v", idValue)
+	keys := map[string]string{}
+	for _, idx := range d.allIndexes() {
+		value, err := indexFieldValue(idx, m)
+		if err != nil {
+			return nil, err
+		}
+		values, err := indexValues(idx, value)
+		if err != nil {
+			return nil, err
+		}
+		for j, value := range values {
+			key, err := d.indexToKey(context.Background(), idx, id, value, true)
+			if err != nil {
+				return nil, err
+			}
+			name := indexName(idx)
+			if idx.MultiValue {
+				name = fmt.Sprintf("%v[%v]", name, j)
+			}
+			keys[name] = key
+		}
+	}
+	return keys, nil
+}
+
+// PrefixForQuery computes the store key prefix List would scan for the
+// query, through the same index resolution and encoding.
+func (d *db) PrefixForQuery(query Query) (string, error) {
+	_, prefix, ok := d.Explain(query)
+	if !ok {
+		return "", queryIndexError(query)
+	}
+	if prefix == "" {
+		return "", fmt.Errorf("the query value cannot be encoded for field '%v'", query.FieldName)
+	}
+	return prefix, nil
+}
+
+// Count counts the records matching the query. Equality counts list only
+// the index keys, skipping the record values entirely; range queries reuse
+// the record scan but never unmarshal the values. On a soft delete model
+// every count resolves the records instead, so deleted ones are excluded
+// like on the read paths.
+func (d *db) Count(query Query) (int64, error) {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if query.Type == queryTypeEq && !d.options.SoftDelete {
+			k, err := d.queryToListKey(context.Background(), idx, query)
+			if err != nil {
+				return 0, err
+			}
+			keys, err := d.options.Store.List(store.ListPrefix(k))
+			if err != nil {
+				return 0, err
+			}
+			count := int64(len(keys))
+			if query.Offset > 0 {
+				count -= query.Offset
+				if count < 0 {
+					count = 0
+				}
+			}
+			if query.Limit > 0 && count > query.Limit {
+				count = query.Limit
+			}
+			return count, nil
+		}
+		recs, err := d.listRecords(idx, query)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(recs)), nil
+	}
+	return 0, queryIndexError(query)
+}
+
+// Exists returns whether any record matches the query. Equality queries list
+// at most one index key; range queries read a single matching record. On a
+// soft delete model the records are resolved instead, so a deleted record
+// no longer counts as existing.
+func (d *db) Exists(query Query) (bool, error) {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if query.Type == queryTypeEq && !d.options.SoftDelete {
+			k, err := d.queryToListKey(context.Background(), idx, query)
+			if err != nil {
+				return false, err
+			}
+			keys, err := d.options.Store.List(store.ListPrefix(k), store.ListLimit(1))
+			if err != nil {
+				return false, err
+			}
+			return len(keys) > 0, nil
+		}
+		q := query
+		q.Offset, q.Limit = 0, 1
+		recs, err := d.listRecords(idx, q)
+		if err != nil {
+			return false, err
+		}
+		return len(recs) > 0, nil
+	}
+	return false, queryIndexError(query)
+}
+
+// toInt64 reads a numeric field off a decoded record. json decodes numbers
+// to float64, reflection yields int64; anything else counts as zero.
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case json.Number:
+		i, _ := n.Int64()
+		return i
+	}
+	return 0
+}
+
+// indexValues expands the value an index keys into the individual values to
+// encode — one per slice element for multi value indexes, otherwise just the
+// value itself. A nil or missing field keys nothing: the record is simply
+// absent from that index and never shows up in its scans, rather than being
+// keyed under some made-up null encoding.
+func indexValues(i Index, value interface{}) ([]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if !i.MultiValue {
+		return []interface{}{value}, nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("multi value index on '%v' requires a slice, got %T", i.FieldName, value)
+	}
+	values := make([]interface{}, rv.Len())
+	for j := 0; j < rv.Len(); j++ {
+		values[j] = rv.Index(j).Interface()
+	}
+	return values, nil
+}
+
+// indexFieldValue picks the value an index encodes from a decoded record.
+// Composite indexes receive the whole record map and pick out their own
+// component fields.
+func indexFieldValue(i Index, m map[string]interface{}) (interface{}, error) {
+	if len(i.FieldNames) > 1 {
+		return m, nil
+	}
+	if i.OrderFieldName != "" && i.OrderFieldName != i.FieldName {
+		return m, nil
+	}
+	return resolveFieldValue(m, i.FieldName)
+}
+
+// resolveFieldValue looks up a field in a decoded record. Dotted paths like
+// "address.city" descend into nested maps produced by the JSON decode.
+func resolveFieldValue(m map[string]interface{}, path string) (interface{}, error) {
+	if !strings.Contains(path, ".") {
+		return m[path], nil
+	}
+	var current interface{} = m
+	for _, segment := range strings.Split(path, ".") {
+		mp, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field path '%v': value before segment '%v' is not an object", path, segment)
+		}
+		current = mp[segment]
+	}
+	return current, nil
+}
+
+// unmarshalRecords decodes each record individually through the codec and
+// appends it to the result slice via reflection, so stored values do not
+// have to be json. The slice is grown to its final size up front — one
+// element per record — so a large listing allocates the backing array once
+// instead of doubling its way there.
+func (d *db) unmarshalRecords(recs []*store.Record, resultSlicePointer interface{}) error {
+	rv := reflect.ValueOf(resultSlicePointer)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("result must be a pointer to a slice")
+	}
+	slice := rv.Elem()
+	slice.Grow(len(recs))
+	elemType := slice.Type().Elem()
+	for _, rec := range recs {
+		elem := reflect.New(elemType)
+		if err := d.decode(rec.Value, elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+// listRecords reads the store records matching the query from an index.
+func (d *db) listRecords(i Index, q Query) ([]*store.Record, error) {
+	return d.listRecordsContext(context.Background(), i, q)
+}
+
+func (d *db) listRecordsContext(ctx context.Context, i Index, q Query) ([]*store.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch q.Type {
+	case queryTypeGt, queryTypeLt, queryTypeBetween, queryTypeNotEq:
+		return d.listRangeRecords(ctx, i, q)
+	case queryTypeStartsWith:
+		return d.listStartsWithRecords(ctx, i, q)
+	}
+	k, err := d.queryToListKey(ctx, i, q)
+	if err != nil {
+		return nil, err
+	}
+	span := spanFromContext(ctx)
+	span.SetAttribute("index", indexName(i))
+	span.SetAttribute("prefix", k)
+	d.debugf("listing key '%v'", k)
+	// push the pagination down to the store so the full prefix is not
+	// materialized just to return a page. With soft deletes the filtering
+	// happens after the read, so a bounded read could come up short there;
+	// a reversed read pages from the wrong end.
+	reverse := q.Desc != i.Desc
+	opts := []store.ReadOption{store.ReadPrefix()}
+	if reverse && d.options.ReverseReads {
+		// the store iterates the prefix backward, so the records already
+		// arrive in the requested order and pagination pushes down like on
+		// a forward read
+		opts = append(opts, store.ReadDescending())
+		reverse = false
+	}
+	if !d.options.SoftDelete && !reverse {
+		if q.Offset > 0 {
+			opts = append(opts, store.ReadOffset(uint(q.Offset)))
+		}
+		if q.Limit > 0 {
+			opts = append(opts, store.ReadLimit(uint(q.Limit)))
+		}
+	}
+	recs, err := d.options.Store.Read(k, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if recs, err = d.dereference(i, recs); err != nil {
+		return nil, err
+	}
+	if d.options.SoftDelete {
+		if recs, err = d.filterDeleted(recs, q); err != nil {
+			return nil, err
+		}
+	}
+	if reverse {
+		reverseRecords(recs)
+	}
+	if d.options.SoftDelete || reverse {
+		recs = applyOffsetLimit(recs, q)
+	}
+	span.SetAttribute("records", len(recs))
+	return recs, nil
+}
+
+// dereference resolves records read off a reference index — whose values
+// hold only the id key of the record — into the full bodies. A reference
+// whose record vanished between the index read and the lookup is dropped.
+// Reads off the id index pass through untouched.
+func (d *db) dereference(i Index, recs []*store.Record) ([]*store.Record, error) {
+	if !d.options.IndexByReference || i.FieldName == d.options.IDField {
+		return recs, nil
+	}
+	out := make([]*store.Record, 0, len(recs))
+	for _, rec := range recs {
+		read, err := d.options.Store.Read(string(rec.Value))
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &store.Record{Key: rec.Key, Value: read[0].Value})
+	}
+	return out, nil
+}
+
+// reverseRecords flips a result set in place, for queries requesting the
+// opposite direction to the one the index keys are stored in.
+func reverseRecords(recs []*store.Record) {
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+}
+
+// applyOffsetLimit pages a result set that was filtered in memory. A zero
+// Limit means no limit and an Offset past the end yields an empty slice.
+func applyOffsetLimit(recs []*store.Record, q Query) []*store.Record {
+	if q.Offset > 0 {
+		if int64(len(recs)) <= q.Offset {
+			return []*store.Record{}
+		}
+		recs = recs[q.Offset:]
+	}
+	if q.Limit > 0 && int64(len(recs)) > q.Limit {
+		recs = recs[:q.Limit]
+	}
+	return recs
+}
+
+// listStartsWithRecords serves a StartsWith query with a prefix read over
+// the encoded query term. The encoding of a term is a string prefix of the
+// encoding of any string starting with it, except for base32 where only
+// complete groups are, so matches are re-checked against the decoded field
+// value before being returned.
+func (d *db) listStartsWithRecords(ctx context.Context, i Index, q Query) ([]*store.Record, error) {
+	if i.Encrypted {
+		return nil, fmt.Errorf("field '%v' is indexed encrypted; only Equals queries are supported", q.FieldName)
+	}
+	term, ok := q.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("StartsWith on field '%v' requires a string value, got %T", q.FieldName, q.Value)
+	}
+	prefix := fmt.Sprintf("%v:%v:%v", d.namespace(ctx), indexName(i), escapeKeyPart(d.getOrderedStringPrefixKey(i, term)))
+	d.debugf("prefix listing key '%v'", prefix)
+	recs, err := d.options.Store.Read(prefix, store.ReadPrefix())
+	if err != nil {
+		return nil, err
+	}
+	if recs, err = d.dereference(i, recs); err != nil {
+		return nil, err
+	}
+	matched := []*store.Record{}
+	for _, rec := range recs {
+		m := map[string]interface{}{}
+		if err := d.decode(rec.Value, &m); err != nil {
+			return nil, err
+		}
+		value, err := resolveFieldValue(m, q.FieldName)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := value.(string); ok && strings.HasPrefix(s, term) {
+			matched = append(matched, rec)
+		}
+	}
+	matched, err = d.filterDeleted(matched, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Desc != i.Desc {
+		reverseRecords(matched)
+	}
+	return applyOffsetLimit(matched, q), nil
+}
+
+// listRangeRecords scans an ordered index and keeps the records on the right
+// side of the encoded boundary key. The key encodings are fixed width, so a
+// plain string comparison on the encoded keys follows the value order. On
+// descending indexes the encoding is inverted, so the comparison inverts too.
+func (d *db) listRangeRecords(ctx context.Context, i Index, q Query) ([]*store.Record, error) {
+	if i.Encrypted {
+		return nil, fmt.Errorf("field '%v' is indexed encrypted; only Equals queries are supported", q.FieldName)
+	}
+	prefix := fmt.Sprintf("%v:%v:", d.namespace(ctx), indexName(i))
+	boundary, err := d.getFieldKey(i, q.Value)
+	if err != nil {
+		return nil, err
+	}
+	var upper string
+	if q.Type == queryTypeBetween {
+		upper, err = d.getFieldKey(i, q.To)
+		if err != nil {
+			return nil, err
+		}
+		if i.Desc {
+			// the encoding inverts on descending indexes, so the encoded
+			// low bound becomes the encoded upper one
+			boundary, upper = upper, boundary
+		}
+	}
+	d.debugf("range listing key '%v' around '%v'", prefix, boundary)
+	recs, err := d.options.Store.Read(prefix, store.ReadPrefix())
+	if err != nil {
+		return nil, err
+	}
+	matched := []*store.Record{}
+	for _, rec := range recs {
+		fieldKey := rec.Key[len(prefix):]
+		// strip the trailing record id
+		if j := strings.LastIndex(fieldKey, ":"); j >= 0 {
+			fieldKey = fieldKey[:j]
+		}
+		if q.Type == queryTypeBetween {
+			if fieldKey >= boundary && fieldKey <= upper {
+				matched = append(matched, rec)
+			}
+			continue
+		}
+		if q.Type == queryTypeNotEq {
+			// the keys below and above the excluded one, still in key order
+			if fieldKey != boundary {
+				matched = append(matched, rec)
+			}
+			continue
+		}
+		greater := fieldKey > boundary
+		if i.Desc {
+			greater = fieldKey < boundary
+		}
+		switch {
+		case q.Type == queryTypeGt && greater,
+			q.Type == queryTypeLt && !greater && fieldKey != boundary:
+			matched = append(matched, rec)
+		}
+	}
+	if matched, err = d.dereference(i, matched); err != nil {
+		return nil, err
+	}
+	matched, err = d.filterDeleted(matched, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Desc != i.Desc {
+		reverseRecords(matched)
+	}
+	return applyOffsetLimit(matched, q), nil
+}
+
+// scanRecords serves a query no index can, by walking the whole id index
+// and filtering the decoded records in memory. Every record in the namespace
+// is read and decoded, so this is strictly a fallback for ad-hoc queries —
+// each scan is reported through the logger. Results come back in id order.
+func (d *db) scanRecords(ctx context.Context, q Query) ([]*store.Record, error) {
+	d.options.Logger.Logf("full scan: no index serves query type '%v' on field '%v'", q.Type, q.FieldName)
+	prefix := fmt.Sprintf("%v:%v:", d.namespace(ctx), indexName(d.idIndex))
+	recs, err := d.options.Store.Read(prefix, store.ReadPrefix())
+	if err != nil {
+		return nil, err
+	}
+	matched := []*store.Record{}
+	for _, rec := range recs {
+		m := map[string]interface{}{}
+		if err := d.decode(rec.Value, &m); err != nil {
+			return nil, err
+		}
+		value, err := resolveFieldValue(m, q.FieldName)
+		if err != nil {
+			// records without the field simply do not match
+			continue
+		}
+		if scanMatches(q, value) {
+			matched = append(matched, rec)
+		}
+	}
+	matched, err = d.filterDeleted(matched, q)
+	if err != nil {
+		return nil, err
+	}
+	return applyOffsetLimit(matched, q), nil
+}
+
+// scanMatches compares a decoded field value against a query without any
+// key encoding involved. Numeric comparisons go through float64; values that
+// are not numbers on both sides compare by their string forms.
+func scanMatches(q Query, value interface{}) bool {
+	switch q.Type {
+	case queryTypeEq:
+		return fmt.Sprintf("%v", value) == fmt.Sprintf("%v", q.Value)
+	case queryTypeNotEq:
+		return fmt.Sprintf("%v", value) != fmt.Sprintf("%v", q.Value)
+	case queryTypeStartsWith:
+		s, ok := value.(string)
+		term, tok := q.Value.(string)
+		return ok && tok && strings.HasPrefix(s, term)
+	case queryTypeGt, queryTypeLt, queryTypeBetween:
+		f, fok := toFloat64(value)
+		low, lok := toFloat64(q.Value)
+		if fok && lok {
+			switch q.Type {
+			case queryTypeGt:
+				return f > low
+			case queryTypeLt:
+				return f < low
+			}
+			high, hok := toFloat64(q.To)
+			return hok && f >= low && f <= high
+		}
+		s := fmt.Sprintf("%v", value)
+		b := fmt.Sprintf("%v", q.Value)
+		switch q.Type {
+		case queryTypeGt:
+			return s > b
+		case queryTypeLt:
+			return s < b
+		}
+		return s >= b && s <= fmt.Sprintf("%v", q.To)
+	}
+	return false
+}
+
+// Delete deletes the record matching an id equality query, or a unique
+// secondary index equality query. Deleting by a non unique index is refused
+// since multiple records could match.
+func (d *db) Delete(query Query) error {
+	return d.DeleteContext(context.Background(), query)
+}
+
+func (d *db) DeleteContext(ctx context.Context, query Query) error {
+	start := time.Now()
+	ctx, span := d.startSpan(ctx, "model.Delete")
+	err := d.deleteContext(ctx, query)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	d.options.Metrics.ObserveOp("delete", time.Since(start), err)
+	return err
+}
+
+func (d *db) deleteContext(ctx context.Context, query Query) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if query.FieldName == d.options.IDField && query.Type != queryTypeEq {
+		// a non equality delete on the id resolves the record like the
+		// unique index deletes below — the key build of the equality path
+		// would treat the boundary value as the id to remove
+		m := map[string]interface{}{}
+		if err := d.readContext(ctx, query, &m); err != nil {
+			return err
+		}
+		return d.deleteRecordKeys(ctx, m)
+	}
+	if query.FieldName == d.options.IDField {
+		// build the key through the same type aware encoding Save uses, so
+		// numeric and boolean ids produce the key that was written
+		id := fmt.Sprintf("%v", query.Value)
+		key, err := d.indexToKey(ctx, d.idIndex, id, query.Value, true)
+		if err != nil {
+			return err
+		}
+		// read the record back so its secondary index keys can be removed
+		// too, not just the id key
+		recs, err := d.options.Store.Read(key)
+		if err == store.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m := map[string]interface{}{}
+		if err := d.decode(recs[0].Value, &m); err != nil {
+			return err
+		}
+		return d.deleteRecordKeys(ctx, m)
+	}
+	for _, idx := range d.options.Indexes {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		if !idx.Unique {
+			return fmt.Errorf("delete by field '%v' requires a unique index", query.FieldName)
+		}
+		// resolve the record so every one of its index keys can be removed
+		m := map[string]interface{}{}
+		if err := d.readContext(ctx, query, &m); err != nil {
+			return err
+		}
+		return d.deleteRecordKeys(ctx, m)
+	}
+	return errors.New("delete query does not match the id index or any unique index")
+}
+
+// SoftDelete marks the record matching the query as deleted, keeping it in
+// the store for auditing. The rewrite goes through Save, so the record stays
+// in its secondary indexes and the read paths filter it out after decoding.
+func (d *db) SoftDelete(query Query) error {
+	if !d.options.SoftDelete {
+		return errors.New("soft deletes are not enabled on this model")
+	}
+	// read the record including an already deleted one, so a double soft
+	// delete stays idempotent rather than reporting not found
+	query.IncludeDeleted = true
+	return d.Update(query, map[string]interface{}{d.options.DeletedField: true})
+}
+
+// filterDeleted drops soft deleted records from a result set. Records are
+// peeked at as maps, which costs a decode per record but never misses a
+// live one.
+func (d *db) filterDeleted(recs []*store.Record, q Query) ([]*store.Record, error) {
+	if !d.options.SoftDelete || q.IncludeDeleted {
+		return recs, nil
+	}
+	kept := recs[:0:0]
+	for _, rec := range recs {
+		m := map[string]interface{}{}
+		if err := d.decode(rec.Value, &m); err != nil {
+			return nil, err
+		}
+		if deleted, ok := m[d.options.DeletedField].(bool); ok && deleted {
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	return kept, nil
+}
+
+// Update applies a partial edit to the record matching the query. The stored
+// record is read as a map, the changes are merged over it and the result goes
+// back through Save, so unique checks and stale index key deletion behave
+// exactly as they would for a full rewrite. Dotted change keys descend into
+// nested objects.
+func (d *db) Update(query Query, changes map[string]interface{}) error {
+	m := map[string]interface{}{}
+	if err := d.Read(query, &m); err != nil {
+		return err
+	}
+	for path, value := range changes {
+		setPathValue(m, path, value)
+	}
+	return d.Save(m)
+}
+
+// DeleteMany deletes all the records matching the query. Each record is
+// resolved through the matching index and removed together with every one of
+// its index keys, so cleanups like "delete all sessions for a user" leave no
+// strays behind. Keys that are already gone are not an error.
+func (d *db) DeleteMany(query Query) (int64, error) {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		recs, err := d.listRecords(idx, query)
+		if err != nil {
+			return 0, err
+		}
+		var deleted int64
+		for _, rec := range recs {
+			m := map[string]interface{}{}
+			if err := d.decode(rec.Value, &m); err != nil {
+				return deleted, err
+			}
+			if err := d.deleteRecordKeys(context.Background(), m); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		return deleted, nil
+	}
+	return 0, queryIndexError(query)
+}
+
+// DeleteAll deletes every key beginning with the model's namespace prefix.
+// All indexes share that prefix, so one listing covers the id index, every
+// secondary index and the auto increment counter. The namespace must be non
+// empty — an empty one would wipe the whole store, not one model's data.
+func (d *db) DeleteAll() error {
+	if strings.TrimSpace(d.options.Namespace) == "" {
+		return errors.New("refusing to delete all with an empty namespace")
+	}
+	prefix := fmt.Sprintf("%v:", d.options.Namespace)
+	keys, err := d.options.Store.List(store.ListPrefix(prefix))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		d.debugf("deleting key '%v'", key)
+		if err := d.options.Store.Delete(key); err != nil {
+			return err
+		}
+	}
+	if d.cache != nil {
+		d.cache.clear()
+	}
+	return nil
+}
+
+// deleteRecordKeys removes every index key written for a record.
+func (d *db) deleteRecordKeys(ctx context.Context, m map[string]interface{}) error {
+	idValue, ok := m[d.options.IDField]
+	if !ok {
+		return fmt.Errorf("record has no '%v' field", d.options.IDField)
+	}
+	id := fmt.Sprintf("%v", idValue)
+	for _, idx := range d.options.Indexes {
+		value, err := indexFieldValue(idx, m)
+		if err != nil {
+			return err
+		}
+		values, err := indexValues(idx, value)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			key, err := d.indexToKey(ctx, idx, id, value, true)
+			if err != nil {
+				return err
+			}
+			d.debugf("deleting key '%v'", key)
+			if err := d.options.Store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	idKey, err := d.indexToKey(ctx, d.idIndex, id, idValue, true)
+	if err != nil {
+		return err
+	}
+	if err := d.options.Store.Delete(idKey); err != nil {
+		return err
+	}
+	if d.cache != nil {
+		d.cache.evict(fmt.Sprintf("%v:%v", d.namespace(ctx), id))
+	}
+	if d.options.AfterDelete != nil {
+		d.options.AfterDelete(id)
+	}
+	d.notify(EventDelete, id, m)
+	return nil
+}
@@ -0,0 +1,3971 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/website/model/store"
+)
+
+type user struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+// newTestModel constructs a model and fails the test on a validation error.
+func newTestModel(t *testing.T, opts ...Option) Model {
+	t.Helper()
+	m, err := NewModel(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewModelValidation(t *testing.T) {
+	if _, err := NewModel(WithIndexes(Index{})); err == nil {
+		t.Fatal("expected an empty field name to be rejected")
+	}
+
+	padless := Index{FieldName: "name", Type: "eq", Ordered: true}
+	if _, err := NewModel(WithIndexes(padless)); err == nil {
+		t.Fatal("expected a zero pad length on an ordered index to be rejected")
+	}
+
+	if _, err := NewModel(WithIndexes(ByEquality("name"))); err != nil {
+		t.Fatalf("expected a valid index to pass, got %v", err)
+	}
+}
+
+func TestSaveRead(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alice" {
+		t.Fatalf("expected alice, got %v", u.Name)
+	}
+
+	if err := m.Read(Equals("name", "alice"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "1" {
+		t.Fatalf("expected id 1, got %v", u.ID)
+	}
+
+	if err := m.Read(Equals("id", "nosuch"), &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestListEquality(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i, name := range []string{"alice", "alice", "bob"} {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []user{}
+	if err := m.List(Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", len(users))
+	}
+	for _, u := range users {
+		if u.Name != "alice" {
+			t.Fatalf("expected alice, got %v", u.Name)
+		}
+	}
+}
+
+func TestRangeQueries(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i, age := range []int{20, 30, 40} {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "u", Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []user{}
+	if err := m.List(GreaterThan("age", 25), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", len(users))
+	}
+	if users[0].Age != 30 || users[1].Age != 40 {
+		t.Fatalf("expected ascending ages 30, 40, got %v, %v", users[0].Age, users[1].Age)
+	}
+
+	users = []user{}
+	if err := m.List(LessThan("age", 30), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Age != 20 {
+		t.Fatalf("expected only age 20, got %v", users)
+	}
+
+	users = []user{}
+	if err := m.List(Between("age", 20, 30), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", len(users))
+	}
+	if users[0].Age != 20 || users[1].Age != 30 {
+		t.Fatalf("expected inclusive bounds 20, 30, got %v, %v", users[0].Age, users[1].Age)
+	}
+}
+
+func TestOffsetLimit(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := Equals("name", "same")
+	q.Offset = 1
+	q.Limit = 2
+	users := []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", len(users))
+	}
+
+	q.Offset = 10
+	q.Limit = 0
+	users = []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no users past the end, got %v", len(users))
+	}
+}
+
+func TestListPage(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := Equals("name", "same")
+	q.Limit = 2
+	seen := 0
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		users := []user{}
+		cursor, err := m.ListPage(q, &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen += len(users)
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if seen != 5 {
+		t.Fatalf("expected to page through 5 users, got %v", seen)
+	}
+}
+
+func TestListPageDescending(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same", Age: 20 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a descending query hands out pages from the high end; the cursor must
+	// advance instead of replaying the first page forever
+	q := ListAll("age").WithLimit(2).Reverse()
+	ages := []int{}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("the cursor did not advance")
+		}
+		users := []user{}
+		cursor, err := m.ListPage(q, &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			ages = append(ages, u.Age)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	want := []int{24, 23, 22, 21, 20}
+	if len(ages) != len(want) {
+		t.Fatalf("expected %v ages, got %v", want, ages)
+	}
+	for i, age := range ages {
+		if age != want[i] {
+			t.Fatalf("expected the descending pages %v, got %v", want, ages)
+		}
+	}
+}
+
+// volumeStore wraps a store and tallies the record bodies handed out by Read,
+// so paging tests can tell a page-sized read from a full rescan.
+type volumeStore struct {
+	store.Store
+	mu      sync.Mutex
+	records int
+}
+
+func (v *volumeStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	recs, err := v.Store.Read(key, opts...)
+	v.mu.Lock()
+	v.records += len(recs)
+	v.mu.Unlock()
+	return recs, err
+}
+
+func (v *volumeStore) recordCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.records
+}
+
+func TestListPageReadVolume(t *testing.T) {
+	vs := &volumeStore{Store: store.NewMemoryStore()}
+	m := newTestModel(t, WithStore(vs), WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 9; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := Equals("name", "same")
+	q.Limit = 3
+	before := vs.recordCount()
+	seen := 0
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("too many pages")
+		}
+		users := []user{}
+		cursor, err := m.ListPage(q, &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen += len(users)
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if seen != 9 {
+		t.Fatalf("expected to page through 9 users, got %v", seen)
+	}
+	// each page reads only its own records, so the whole walk reads every
+	// record once instead of the full set over again per page
+	if read := vs.recordCount() - before; read != 9 {
+		t.Fatalf("expected 9 record reads across the pages, got %v", read)
+	}
+}
+
+func TestListPageDescendingIndex(t *testing.T) {
+	ageIndex := ByEquality("age")
+	ageIndex.Desc = true
+	m := newTestModel(t, WithIndexes(ageIndex))
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same", Age: 20 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an ascending query over a descending index walks the keys backward, so
+	// the cursor comparison has to follow the key order, not the query order
+	q := ListAll("age").WithLimit(2)
+	ages := []int{}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("the cursor did not advance")
+		}
+		users := []user{}
+		cursor, err := m.ListPage(q, &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			ages = append(ages, u.Age)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	want := []int{20, 21, 22, 23, 24}
+	if len(ages) != len(want) {
+		t.Fatalf("expected %v ages, got %v", want, ages)
+	}
+	for i, age := range ages {
+		if age != want[i] {
+			t.Fatalf("expected the ascending pages %v, got %v", want, ages)
+		}
+	}
+}
+
+func TestListPageSoftDelete(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")), WithSoftDelete())
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SoftDelete(Equals("id", "3")); err != nil {
+		t.Fatal(err)
+	}
+
+	q := Equals("name", "same")
+	q.Limit = 2
+	seen := []string{}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		users := []user{}
+		cursor, err := m.ListPage(q, &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			seen = append(seen, u.ID)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected to page through 4 live users, got %v", seen)
+	}
+	for _, id := range seen {
+		if id == "3" {
+			t.Fatal("a soft deleted user surfaced in a page")
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 3; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := m.Count(Equals("name", "same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != 3 {
+		t.Fatalf("expected count 3, got %v", c)
+	}
+
+	c, err = m.Count(Equals("name", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != 0 {
+		t.Fatalf("expected count 0, got %v", c)
+	}
+}
+
+func TestDescendingLargeInts(t *testing.T) {
+	ageIndex := ByEquality("age")
+	ageIndex.Desc = true
+	m := newTestModel(t, WithIndexes(ageIndex))
+
+	// values past MaxInt32 used to produce broken descending keys
+	ages := []int{1 << 40, 1 << 20, 1 << 35}
+	for i, age := range ages {
+		if err := m.Save(user{ID: string(rune('1' + i)), Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := GreaterThan("age", 0)
+	q.Desc = true
+	users := []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users, got %v", len(users))
+	}
+	if users[0].Age != 1<<40 || users[1].Age != 1<<35 || users[2].Age != 1<<20 {
+		t.Fatalf("expected descending ages, got %v %v %v", users[0].Age, users[1].Age, users[2].Age)
+	}
+}
+
+func TestNegativeIntOrdering(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	ages := []int{5, -3, 0, -40, 12}
+	for i, age := range ages {
+		if err := m.Save(user{ID: string(rune('a' + i)), Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []user{}
+	if err := m.List(GreaterThan("age", -100), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 5 {
+		t.Fatalf("expected 5 users, got %v", len(users))
+	}
+	want := []int{-40, -3, 0, 5, 12}
+	for i, u := range users {
+		if u.Age != want[i] {
+			t.Fatalf("expected ascending ages %v, got %v", want, users)
+		}
+	}
+
+	users = []user{}
+	if err := m.List(LessThan("age", 0), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 negative ages, got %v", users)
+	}
+}
+
+func TestFloatOrdering(t *testing.T) {
+	type product struct {
+		ID    string  `json:"id"`
+		Price float64 `json:"price"`
+	}
+	m := newTestModel(t, WithIndexes(ByEquality("price")))
+
+	// whole and fractional values mixed on one field must sort together
+	prices := []float64{4, 1.5, 10, -2.25, 0.5, 99.9, -3}
+	for i, p := range prices {
+		if err := m.Save(product{ID: string(rune('a' + i)), Price: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	products := []product{}
+	if err := m.List(GreaterThan("price", -100.5), &products); err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{-3, -2.25, 0.5, 1.5, 4, 10, 99.9}
+	if len(products) != len(want) {
+		t.Fatalf("expected %v products, got %v", len(want), len(products))
+	}
+	for i, p := range products {
+		if p.Price != want[i] {
+			t.Fatalf("expected ascending prices %v, got %v", want, products)
+		}
+	}
+
+	// range bounds falling between whole and fractional values
+	products = nil
+	if err := m.List(GreaterThan("price", 2), &products); err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 3 || products[0].Price != 4 || products[1].Price != 10 || products[2].Price != 99.9 {
+		t.Fatalf("expected the prices above 2 in order, got %v", products)
+	}
+	products = nil
+	if err := m.List(Between("price", 1, 5), &products); err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0].Price != 1.5 || products[1].Price != 4 {
+		t.Fatalf("expected the prices between 1 and 5, got %v", products)
+	}
+}
+
+func TestFloatKeyEncoding(t *testing.T) {
+	d := newTestModel(t).(*db)
+	i := ByEquality("price")
+	key := func(i Index, v float64) string {
+		k, err := d.getOrderedFloatFieldKey(i, "price", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	// keys must sort in numeric order across whole and fractional values,
+	// including the infinities
+	values := []float64{math.Inf(-1), -1e9, -3, -2.25, -0.75, 0, 0.5, 1, 1.5, 4, 10, 10.5, 1e9, math.Inf(1)}
+	for j := 1; j < len(values); j++ {
+		prev := key(i, values[j-1])
+		cur := key(i, values[j])
+		if prev >= cur {
+			t.Fatalf("key for %v (%v) not below key for %v (%v)", values[j-1], prev, values[j], cur)
+		}
+	}
+
+	// a whole float and the equal integer produce the identical key
+	if key(i, 4) != d.getOrderedIntFieldKey(i, 4) {
+		t.Fatalf("expected the float key for 4 (%v) to equal the integer key (%v)", key(i, 4), d.getOrderedIntFieldKey(i, 4))
+	}
+
+	// NaN encodes outside the infinities rather than corrupting the order
+	nan := key(i, math.NaN())
+	if nan <= key(i, math.Inf(1)) && nan >= key(i, math.Inf(-1)) {
+		t.Fatalf("expected NaN key outside the infinities, got %v", nan)
+	}
+
+	// a value whose integer part leaves the encodable range is rejected
+	if _, err := d.getOrderedFloatFieldKey(i, "price", 1e300); err == nil {
+		t.Fatal("expected an out of range value to be rejected")
+	}
+
+	// descending inverts the comparison, for fractional and whole values
+	di := ByEquality("price")
+	di.Desc = true
+	if key(di, -2.25) <= key(di, 10.5) {
+		t.Fatal("expected descending float keys to invert")
+	}
+	if key(di, 1.5) <= key(di, 4) {
+		t.Fatal("expected descending mixed keys to invert")
+	}
+}
+
+func TestSeparatorEscaping(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "a:1", Name: "a:b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	users := []user{}
+	if err := m.List(Equals("name", "a"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != "2" {
+		t.Fatalf("expected only the plain 'a' record, got %v", users)
+	}
+
+	users = []user{}
+	if err := m.List(Equals("name", "a:b"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != "a:1" {
+		t.Fatalf("expected only the 'a:b' record, got %v", users)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	emailIndex := ByEquality("email")
+	emailIndex.Unique = true
+	m := newTestModel(t, WithIndexes(emailIndex))
+
+	type account struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	}
+
+	if err := m.Save(account{ID: "1", Email: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// same record again is fine
+	if err := m.Save(account{ID: "1", Email: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// a different record with the same email is not
+	err := m.Save(account{ID: "2", Email: "a@example.com"})
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("expected ErrUniqueViolation, got %v", err)
+	}
+	var uve *UniqueViolationError
+	if !errors.As(err, &uve) || uve.FieldName() != "email" {
+		t.Fatalf("expected the violated field to be email, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m := newTestModel(t)
+
+	if err := m.Save(user{ID: "1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestDeleteByUniqueIndex(t *testing.T) {
+	emailIndex := ByEquality("email")
+	emailIndex.Unique = true
+	nameIndex := ByEquality("name")
+	m := newTestModel(t, WithIndexes(emailIndex, nameIndex))
+
+	type account struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+
+	if err := m.Save(account{ID: "1", Email: "a@example.com", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting by a non unique index is refused
+	if err := m.Delete(Equals("name", "alice")); err == nil {
+		t.Fatal("expected delete by non unique index to fail")
+	}
+
+	if err := m.Delete(Equals("email", "a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	var a account
+	if err := m.Read(Equals("id", "1"), &a); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+	if err := m.Read(Equals("email", "a@example.com"), &a); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound on the email index, got %v", err)
+	}
+}
+
+func TestDeleteRemovesSecondaryKeys(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	users := []user{}
+	if err := m.List(Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no orphaned secondary index entries, got %v", users)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.SaveContext(ctx, user{ID: "1", Name: "alice"}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	users := []user{}
+	if err := m.ListContext(ctx, Equals("name", "alice"), &users); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	type ticket struct {
+		ID       string `json:"id"`
+		TenantID string `json:"tenantId"`
+		Status   string `json:"status"`
+	}
+	m := newTestModel(t, WithIndexes(ByEqualities("tenantId", "status")))
+
+	tickets := []ticket{
+		{ID: "1", TenantID: "acme", Status: "open"},
+		{ID: "2", TenantID: "acme", Status: "closed"},
+		{ID: "3", TenantID: "other", Status: "open"},
+	}
+	for _, tk := range tickets {
+		if err := m.Save(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := []ticket{}
+	// field order in the query must not matter
+	if err := m.List(EqualsPairs(map[string]interface{}{"status": "open", "tenantId": "acme"}), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "1" {
+		t.Fatalf("expected only ticket 1, got %v", got)
+	}
+}
+
+func TestNestedFieldIndex(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type customer struct {
+		ID      string  `json:"id"`
+		Address address `json:"address"`
+	}
+	m := newTestModel(t, WithIndexes(ByEquality("address.city")))
+
+	if err := m.Save(customer{ID: "1", Address: address{City: "london"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(customer{ID: "2", Address: address{City: "berlin"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	customers := []customer{}
+	if err := m.List(Equals("address.city", "london"), &customers); err != nil {
+		t.Fatal(err)
+	}
+	if len(customers) != 1 || customers[0].ID != "1" {
+		t.Fatalf("expected only the london customer, got %v", customers)
+	}
+}
+
+func TestListResultKinds(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 3; i++ {
+		if err := m.Save(user{ID: string(rune('1' + i)), Name: "same", Age: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a typed struct slice
+	users := []user{}
+	if err := m.List(Equals("name", "same"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users, got %v", len(users))
+	}
+
+	// a generic map slice decodes the same records
+	maps := []map[string]interface{}{}
+	if err := m.List(Equals("name", "same"), &maps); err != nil {
+		t.Fatal(err)
+	}
+	if len(maps) != 3 {
+		t.Fatalf("expected 3 maps, got %v", len(maps))
+	}
+	if maps[0]["name"] != "same" {
+		t.Fatalf("expected name 'same', got %v", maps[0]["name"])
+	}
+
+	// anything that is not a pointer to a slice is refused
+	if err := m.List(Equals("name", "same"), users); err == nil {
+		t.Fatal("expected a non-pointer result to fail")
+	}
+}
+
+// flakyStore fails every write after the first n.
+type flakyStore struct {
+	store.Store
+	failAfter int
+	writes    int
+}
+
+func (f *flakyStore) Write(r *store.Record, opts ...store.WriteOption) error {
+	f.writes++
+	if f.writes > f.failAfter {
+		return errors.New("write failed")
+	}
+	return f.Store.Write(r, opts...)
+}
+
+func TestSaveRollback(t *testing.T) {
+	fs := &flakyStore{Store: store.NewMemoryStore(), failAfter: 1}
+	m := newTestModel(t,
+		WithStore(fs),
+		WithIndexes(ByEquality("name"), ByEquality("age")),
+	)
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err == nil {
+		t.Fatal("expected save to fail")
+	}
+
+	// the failed save must not leave any partial index state behind
+	fs.failAfter = 1 << 30
+	users := []user{}
+	if err := m.List(Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no partially indexed records, got %v", users)
+	}
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestUnindexableFieldType(t *testing.T) {
+	type post struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	m := newTestModel(t, WithIndexes(ByEquality("tags")))
+
+	// a slice typed field must produce a clean error, not a panic
+	err := m.Save(post{ID: "1", Tags: []string{"a", "b"}})
+	if err == nil {
+		t.Fatal("expected an error for a slice typed index field")
+	}
+
+	posts := []post{}
+	if err := m.List(Equals("tags", []string{"a"}), &posts); err == nil {
+		t.Fatal("expected an error for a slice typed query value")
+	}
+}
+
+func TestSaveMapInput(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	// map inputs take the json fallback path rather than reflection
+	if err := m.Save(map[string]interface{}{"id": "9", "name": "zed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var u user
+	if err := m.Read(Equals("name", "zed"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "9" {
+		t.Fatalf("expected id 9, got %v", u.ID)
+	}
+}
+
+func TestDeleteNumericID(t *testing.T) {
+	type event struct {
+		ID int64 `json:"id"`
+	}
+	m := newTestModel(t)
+
+	if err := m.Save(event{ID: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(Equals("id", int64(42))); err != nil {
+		t.Fatal(err)
+	}
+	var e event
+	if err := m.Read(Equals("id", int64(42)), &e); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestTimeOrdering(t *testing.T) {
+	type event struct {
+		ID        string    `json:"id"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m := newTestModel(t, WithIndexes(ByEquality("createdAt")))
+	// save out of chronological order
+	for _, offset := range []int{3, 1, 2} {
+		err := m.Save(event{ID: fmt.Sprintf("%d", offset), CreatedAt: base.Add(time.Duration(offset) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := []event{}
+	if err := m.List(GreaterThan("createdAt", base), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i-1].CreatedAt.Before(events[i].CreatedAt) {
+			t.Fatalf("events out of chronological order: %v", events)
+		}
+	}
+
+	descIdx := ByEquality("createdAt")
+	descIdx.Desc = true
+	md := newTestModel(t, WithIndexes(descIdx))
+	for _, offset := range []int{1, 3, 2} {
+		err := md.Save(event{ID: fmt.Sprintf("%d", offset), CreatedAt: base.Add(time.Duration(offset) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := LessThan("createdAt", base.Add(4*time.Hour))
+	q.Desc = true
+	events = nil
+	if err := md.List(q, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i-1].CreatedAt.After(events[i].CreatedAt) {
+			t.Fatalf("events not in reverse chronological order: %v", events)
+		}
+	}
+}
+
+func TestAutoTimestamps(t *testing.T) {
+	type doc struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"createdAt"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}
+	m := newTestModel(t, WithAutoTimestamps())
+
+	if err := m.Save(doc{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	var d doc
+	if err := m.Read(Equals("id", "1"), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.CreatedAt.IsZero() || d.UpdatedAt.IsZero() {
+		t.Fatalf("expected timestamps to be stamped, got %+v", d)
+	}
+
+	created := d.CreatedAt
+	time.Sleep(5 * time.Millisecond)
+	if err := m.Save(doc{ID: "1", Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("id", "1"), &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.CreatedAt.Equal(created) {
+		t.Fatalf("createdAt changed on update: %v != %v", d.CreatedAt, created)
+	}
+	if !d.UpdatedAt.After(created) {
+		t.Fatalf("updatedAt not advanced: %v", d.UpdatedAt)
+	}
+}
+
+func TestTypedModel(t *testing.T) {
+	m := NewTypedModel[user](newTestModel(t, WithIndexes(ByEquality("name"))))
+
+	if err := m.Save(user{ID: "1", Name: "jane", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.Read(Equals("name", "jane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "1" {
+		t.Fatalf("expected id 1, got %v", u.ID)
+	}
+	users, err := m.List(Equals("name", "jane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("expected 1 user, got %v", len(users))
+	}
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Read(Equals("id", "1")); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestSaveBatch(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	// seed a record so the batch mixes an update with inserts
+	if err := m.Save(user{ID: "1", Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	err := m.SaveBatch(
+		user{ID: "1", Name: "new"},
+		user{ID: "2", Name: "two"},
+		user{ID: "3", Name: "three"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []user{}
+	if err := m.List(Equals("name", "old"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("stale index key survived the batched update: %v", users)
+	}
+	var u user
+	if err := m.Read(Equals("name", "three"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "3" {
+		t.Fatalf("expected id 3, got %v", u.ID)
+	}
+}
+
+func TestSaveBatchInsertOnly(t *testing.T) {
+	m := newTestModel(t, WithBatchInsertOnly())
+
+	if err := m.SaveBatch(user{ID: "1", Name: "a"}, user{ID: "2", Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := m.Read(Equals("id", "2"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "b" {
+		t.Fatalf("expected name b, got %v", u.Name)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i, name := range []string{"bulk", "bulk", "keep"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := m.DeleteMany(Equals("name", "bulk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("expected 2 deleted, got %v", deleted)
+	}
+	users := []user{}
+	if err := m.List(Equals("name", "bulk"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no bulk users left, got %v", users)
+	}
+	var u user
+	if err := m.Read(Equals("name", "keep"), &u); err != nil {
+		t.Fatal(err)
+	}
+	// deleting again is not an error, just a zero count
+	if deleted, err = m.DeleteMany(Equals("name", "bulk")); err != nil || deleted != 0 {
+		t.Fatalf("expected 0 deleted with no error, got %v %v", deleted, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "before", Age: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(Equals("id", "1"), map[string]interface{}{"name": "after"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var u user
+	if err := m.Read(Equals("name", "after"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 20 {
+		t.Fatalf("unchanged field clobbered, got %+v", u)
+	}
+	// the stale index key for the old name must be gone
+	users := []user{}
+	if err := m.List(Equals("name", "before"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no users under the old name, got %v", users)
+	}
+	// updating a missing record reports not found
+	if err := m.Update(Equals("id", "404"), map[string]interface{}{"name": "x"}); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestVersionConflict(t *testing.T) {
+	type account struct {
+		ID      string `json:"id"`
+		Balance int    `json:"balance"`
+		Version int64  `json:"version"`
+	}
+	m := newTestModel(t, WithVersionField("version"))
+
+	if err := m.Save(account{ID: "1", Balance: 10}); err != nil {
+		t.Fatal(err)
+	}
+	var a, b account
+	if err := m.Read(Equals("id", "1"), &a); err != nil {
+		t.Fatal(err)
+	}
+	b = a
+
+	a.Balance = 20
+	if err := m.Save(a); err != nil {
+		t.Fatal(err)
+	}
+	// b still carries the old version, so its write must be refused
+	b.Balance = 30
+	if err := m.Save(b); err != ErrVersionConflict {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	var out account
+	if err := m.Read(Equals("id", "1"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Balance != 20 {
+		t.Fatalf("stale write clobbered the record: %+v", out)
+	}
+}
+
+// recordingLocker counts lock acquisitions and tracks balance with unlocks.
+type recordingLocker struct {
+	mu    sync.Mutex
+	locks []string
+	held  int
+}
+
+func (l *recordingLocker) Lock(key string) (func(), error) {
+	l.mu.Lock()
+	l.locks = append(l.locks, key)
+	l.held++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		l.held--
+		l.mu.Unlock()
+	}, nil
+}
+
+func TestSaveLocker(t *testing.T) {
+	locker := &recordingLocker{}
+	m := newTestModel(t, WithLocker(locker))
+
+	if err := m.Save(user{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "1", Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(locker.locks) != 2 || locker.locks[0] != "1" {
+		t.Fatalf("expected two locks on id 1, got %v", locker.locks)
+	}
+	if locker.held != 0 {
+		t.Fatalf("expected all locks released, %v still held", locker.held)
+	}
+}
+
+func TestConcurrentSaveSameID(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := m.Save(user{ID: "1", Name: fmt.Sprintf("name-%d", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// with the saves serialized per id, exactly one name index key survives
+	keys, err := s.List(store.ListPrefix("default:byName:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 name index key, got %v: %v", len(keys), keys)
+	}
+}
+
+func TestSaveTTL(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "fleeting"}, WithTTL(30*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := m.Read(Equals("id", "1"), &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound after expiry, got %v", err)
+	}
+	// the secondary index keys expire together with the id key
+	users := []user{}
+	if err := m.List(Equals("name", "fleeting"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no records via the name index, got %v", users)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	m := newTestModel(t, WithSoftDelete(), WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SoftDelete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// default reads and lists skip the soft deleted record
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+	users := []user{}
+	if err := m.List(Equals("name", "gone"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no visible users, got %v", users)
+	}
+
+	// asking for deleted records brings it back
+	q := Equals("id", "1")
+	q.IncludeDeleted = true
+	if err := m.Read(q, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "gone" {
+		t.Fatalf("expected the retained record, got %+v", u)
+	}
+
+	// counts, existence checks and totals skip the record like reads do
+	if c, err := m.Count(Equals("name", "gone")); err != nil || c != 0 {
+		t.Fatalf("expected count 0, got %v %v", c, err)
+	}
+	if ok, err := m.Exists(Equals("id", "1")); err != nil || ok {
+		t.Fatalf("expected the record to not exist, got %v %v", ok, err)
+	}
+	users = nil
+	if total, err := m.ListWithTotal(Equals("name", "gone"), &users); err != nil || total != 0 || len(users) != 0 {
+		t.Fatalf("expected an empty page with total 0, got %v %v %v", total, users, err)
+	}
+
+	// asking for deleted records counts it again
+	dq := Equals("name", "gone")
+	dq.IncludeDeleted = true
+	if c, err := m.Count(dq); err != nil || c != 1 {
+		t.Fatalf("expected count 1 with deleted included, got %v %v", c, err)
+	}
+
+	// soft deleting without enabling it is refused
+	plain := newTestModel(t)
+	if err := plain.SoftDelete(Equals("id", "1")); err == nil {
+		t.Fatal("expected an error with soft deletes disabled")
+	}
+}
+
+func TestSaveDeleteHooks(t *testing.T) {
+	var beforeOld, afterNew map[string]interface{}
+	var deleted []string
+	m := newTestModel(t,
+		WithBeforeSave(func(id string, old, new map[string]interface{}) error {
+			beforeOld = old
+			if new["name"] == "forbidden" {
+				return errors.New("rejected")
+			}
+			return nil
+		}),
+		WithAfterSave(func(id string, old, new map[string]interface{}) {
+			afterNew = new
+		}),
+		WithAfterDelete(func(id string) {
+			deleted = append(deleted, id)
+		}),
+	)
+
+	if err := m.Save(user{ID: "1", Name: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if beforeOld != nil {
+		t.Fatalf("expected nil old map on create, got %v", beforeOld)
+	}
+	if afterNew["name"] != "first" {
+		t.Fatalf("after hook saw the wrong record: %v", afterNew)
+	}
+
+	if err := m.Save(user{ID: "1", Name: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if beforeOld["name"] != "first" {
+		t.Fatalf("before hook missed the old record: %v", beforeOld)
+	}
+
+	// a before hook error aborts the write
+	if err := m.Save(user{ID: "1", Name: "forbidden"}); err == nil {
+		t.Fatal("expected the before hook to abort the save")
+	}
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "second" {
+		t.Fatalf("aborted save still wrote: %+v", u)
+	}
+
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "1" {
+		t.Fatalf("expected delete hook for id 1, got %v", deleted)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	events, stop, err := m.Watch(Equals("name", "watched"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if err := m.Save(user{ID: "1", Name: "watched"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "1", Name: "watched", Age: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{EventCreate, EventUpdate, EventDelete}
+	for _, want := range expect {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.ID != "1" {
+				t.Fatalf("expected %v for id 1, got %+v", want, ev)
+			}
+			if want == EventDelete && ev.Value != nil {
+				t.Fatalf("delete event carried a value: %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v event", want)
+		}
+	}
+
+	// after stop no further events arrive and the channel closes
+	stop()
+	if err := m.Save(user{ID: "3", Name: "watched"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected the event channel to be closed after stop")
+	}
+}
+
+func TestAutoID(t *testing.T) {
+	m := newTestModel(t, WithAutoID())
+
+	// Create mints an id and returns it
+	id, err := m.Create(user{Name: "minted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expected a generated id")
+	}
+	var u user
+	if err := m.Read(Equals("id", id), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "minted" {
+		t.Fatalf("expected the created record, got %+v", u)
+	}
+
+	// an explicit id is kept as is
+	id, err = m.Create(user{ID: "fixed", Name: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "fixed" {
+		t.Fatalf("expected the explicit id, got %v", id)
+	}
+
+	// Save also mints, the id is just not returned
+	if err := m.Save(user{Name: "saved"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoIncrement(t *testing.T) {
+	type ticket struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+	}
+	m := newTestModel(t, WithAutoIncrement())
+
+	var wg sync.WaitGroup
+	ids := make([]string, 16)
+	for i := 0; i < len(ids); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := m.Create(ticket{Title: fmt.Sprintf("t-%d", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate id allocated: %v", id)
+		}
+		seen[id] = true
+	}
+	// ids are sequential starting at 1, so the first must exist
+	var tk ticket
+	if err := m.Read(Equals("id", int64(1)), &tk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiValueIndex(t *testing.T) {
+	type post struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	tagIndex := ByEquality("tags")
+	tagIndex.MultiValue = true
+	m := newTestModel(t, WithIndexes(tagIndex))
+
+	if err := m.Save(post{ID: "1", Tags: []string{"golang", "kv"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(post{ID: "2", Tags: []string{"golang"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := []post{}
+	if err := m.List(Equals("tags", "golang"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("expected 2 posts tagged golang, got %v", posts)
+	}
+	posts = nil
+	if err := m.List(Equals("tags", "kv"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].ID != "1" {
+		t.Fatalf("expected post 1 tagged kv, got %v", posts)
+	}
+
+	// dropping a tag on update removes its key, adding one creates it
+	if err := m.Save(post{ID: "1", Tags: []string{"kv", "store"}}); err != nil {
+		t.Fatal(err)
+	}
+	posts = nil
+	if err := m.List(Equals("tags", "golang"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].ID != "2" {
+		t.Fatalf("expected only post 2 tagged golang, got %v", posts)
+	}
+	posts = nil
+	if err := m.List(Equals("tags", "store"), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].ID != "1" {
+		t.Fatalf("expected post 1 tagged store, got %v", posts)
+	}
+}
+
+func TestNilIndexedField(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	// a record missing the indexed field saves fine and just stays out of
+	// that index
+	if err := m.Save(map[string]interface{}{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "named"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var u user
+	if err := m.Read(Equals("id", "1"), &u); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(Equals("name", "named"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != "2" {
+		t.Fatalf("expected only the named record, got %v", users)
+	}
+	// deleting the unindexed record does not trip over the missing field
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoolOrdering(t *testing.T) {
+	type task struct {
+		ID   string `json:"id"`
+		Done bool   `json:"done"`
+	}
+	doneIndex := ByEquality("done")
+	doneIndex.Desc = true
+	m := newTestModel(t, WithIndexes(doneIndex))
+
+	if err := m.Save(task{ID: "1", Done: false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(task{ID: "2", Done: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a descending boolean index lists true before false
+	q := GreaterThan("done", false)
+	q.Desc = true
+	tasks := []task{}
+	if err := m.List(q, &tasks); err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || !tasks[0].Done {
+		t.Fatalf("expected only the done task above false, got %v", tasks)
+	}
+	// and equality still resolves each value
+	var tk task
+	if err := m.Read(func() Query { q := Equals("done", false); q.Desc = true; return q }(), &tk); err != nil {
+		t.Fatal(err)
+	}
+	if tk.ID != "1" {
+		t.Fatalf("expected task 1, got %+v", tk)
+	}
+}
+
+func TestSecondarySortByID(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	// all share the same age; numeric ids must come back in numeric order,
+	// not as "1", "10", "2"
+	for _, id := range []string{"10", "2", "1"} {
+		if err := m.Save(user{ID: id, Name: "n" + id, Age: 40}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.List(Equals("age", 40), &users); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1", "2", "10"}
+	if len(users) != len(want) {
+		t.Fatalf("expected %v users, got %v", len(want), users)
+	}
+	for i, id := range want {
+		if users[i].ID != id {
+			t.Fatalf("expected id order %v, got %v", want, users)
+		}
+	}
+}
+
+func TestOrderByDifferentField(t *testing.T) {
+	type post struct {
+		ID       string `json:"id"`
+		Category string `json:"category"`
+		Score    int    `json:"score"`
+	}
+	m := newTestModel(t, WithIndexes(ByEqualityOrderedBy("category", "score", true)))
+
+	for _, p := range []post{
+		{ID: "1", Category: "go", Score: 10},
+		{ID: "2", Category: "go", Score: 30},
+		{ID: "3", Category: "go", Score: 20},
+		{ID: "4", Category: "rust", Score: 99},
+	} {
+		if err := m.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := Equals("category", "go")
+	q.Desc = true
+	posts := []post{}
+	if err := m.List(q, &posts); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{30, 20, 10}
+	if len(posts) != len(want) {
+		t.Fatalf("expected %v posts, got %v", len(want), posts)
+	}
+	for i, score := range want {
+		if posts[i].Score != score {
+			t.Fatalf("expected score order %v, got %v", want, posts)
+		}
+	}
+	// updates move the record within the ordering and drop the stale key
+	if err := m.Save(post{ID: "1", Category: "go", Score: 40}); err != nil {
+		t.Fatal(err)
+	}
+	posts = nil
+	if err := m.List(q, &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 3 || posts[0].Score != 40 {
+		t.Fatalf("expected the updated post first, got %v", posts)
+	}
+}
+
+func TestStartsWith(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i, name := range []string{"john", "joan", "jane"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.List(StartsWith("name", "jo"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected john and joan, got %v", users)
+	}
+	for _, u := range users {
+		if !strings.HasPrefix(u.Name, "jo") {
+			t.Fatalf("unexpected match %v", u.Name)
+		}
+	}
+
+	// an unordered index cannot serve a prefix query
+	unordered := ByEquality("name")
+	unordered.Ordered = false
+	plain := newTestModel(t, WithIndexes(unordered))
+	if err := plain.List(StartsWith("name", "jo"), &users); err == nil {
+		t.Fatal("expected an error for StartsWith on an unordered index")
+	}
+}
+
+func TestStartsWithBase32(t *testing.T) {
+	nameIndex := ByEquality("name")
+	nameIndex.Base32Encode = true
+	m := newTestModel(t, WithIndexes(nameIndex))
+
+	for i, name := range []string{"alphabet", "alpine", "beta"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.List(StartsWith("name", "alp"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected alphabet and alpine, got %v", users)
+	}
+}
+
+func TestBase32OrderingBothDirections(t *testing.T) {
+	asc := ByEquality("name")
+	asc.Base32Encode = true
+	m := newTestModel(t, WithIndexes(asc))
+
+	for i, name := range []string{"czz", "abb", "baa"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.List(GreaterThan("name", "aaa"), &users); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"abb", "baa", "czz"}
+	if len(users) != len(want) {
+		t.Fatalf("expected %v users, got %v", len(want), users)
+	}
+	for i, name := range want {
+		if users[i].Name != name {
+			t.Fatalf("expected ascending order %v, got %v", want, users)
+		}
+	}
+
+	desc := ByEquality("name")
+	desc.Base32Encode = true
+	desc.Desc = true
+	md := newTestModel(t, WithIndexes(desc))
+	for i, name := range []string{"abb", "czz", "baa"} {
+		if err := md.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := LessThan("name", "zzz")
+	q.Desc = true
+	users = nil
+	if err := md.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"czz", "baa", "abb"}
+	if len(users) != len(want) {
+		t.Fatalf("expected %v users, got %v", len(want), users)
+	}
+	for i, name := range want {
+		if users[i].Name != name {
+			t.Fatalf("expected descending order %v, got %v", want, users)
+		}
+	}
+}
+
+func TestPrefixStringOrdering(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	// "abc" must sort before "abcd" despite being padded to full length
+	if err := m.Save(user{ID: "1", Name: "abcd"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(GreaterThan("name", "a"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "abc" || users[1].Name != "abcd" {
+		t.Fatalf("expected abc before abcd, got %v", users)
+	}
+}
+
+func TestSaveWithResult(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	res, err := m.SaveWithResult(user{ID: "1", Name: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one name index key plus the id key
+	if len(res.WrittenKeys) != 2 {
+		t.Fatalf("expected 2 written keys, got %v", res.WrittenKeys)
+	}
+	if len(res.DeletedKeys) != 0 {
+		t.Fatalf("expected no deleted keys on insert, got %v", res.DeletedKeys)
+	}
+
+	res, err = m.SaveWithResult(user{ID: "1", Name: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.WrittenKeys) != 2 {
+		t.Fatalf("expected 2 written keys, got %v", res.WrittenKeys)
+	}
+	// the old name index key got dropped
+	if len(res.DeletedKeys) != 1 {
+		t.Fatalf("expected 1 deleted key, got %v", res.DeletedKeys)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	idx, prefix, ok := m.Explain(Equals("name", "jane"))
+	if !ok {
+		t.Fatal("expected the name index to match")
+	}
+	if idx.FieldName != "name" {
+		t.Fatalf("expected the name index, got %+v", idx)
+	}
+	if !strings.HasPrefix(prefix, "default:byName:") {
+		t.Fatalf("unexpected scan prefix %v", prefix)
+	}
+
+	// range queries scan the whole index
+	if _, prefix, ok = m.Explain(GreaterThan("name", "a")); !ok || prefix != "default:byName:" {
+		t.Fatalf("expected the full index prefix, got %v %v", prefix, ok)
+	}
+
+	// a query on an unindexed field matches nothing
+	if _, _, ok = m.Explain(Equals("email", "x")); ok {
+		t.Fatal("expected no match for an unindexed field")
+	}
+}
+
+func TestKeyComputation(t *testing.T) {
+	s := store.NewMemoryStore()
+	nameIndex := ByEquality("name")
+	m := newTestModel(t, WithStore(s), WithIndexes(nameIndex))
+
+	u := user{ID: "1", Name: "jane"}
+	if err := m.Save(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// the computed key is one the save actually wrote
+	key, err := m.KeyForRecord(nameIndex, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs, err := s.Read(key); err != nil || len(recs) != 1 {
+		t.Fatalf("expected the computed key %q in the store, got %v %v", key, recs, err)
+	}
+
+	// the computed prefix is a prefix of that key
+	prefix, err := m.PrefixForQuery(Equals("name", "jane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, prefix) {
+		t.Fatalf("expected %q to be a prefix of %q", prefix, key)
+	}
+	if _, err := m.PrefixForQuery(Equals("email", "x")); err == nil {
+		t.Fatal("expected an error for an unindexed field")
+	}
+}
+
+// boundedStore wraps a store and records the options of the last read.
+type boundedStore struct {
+	store.Store
+	lastRead store.ReadOptions
+}
+
+func (s *boundedStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	var ro store.ReadOptions
+	for _, o := range opts {
+		o(&ro)
+	}
+	s.lastRead = ro
+	return s.Store.Read(key, opts...)
+}
+
+func TestListPushesLimitToStore(t *testing.T) {
+	s := &boundedStore{Store: store.NewMemoryStore()}
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("age")))
+
+	for i := 0; i < 10; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := Equals("age", 30)
+	q.Limit = 3
+	q.Offset = 2
+	users := []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users, got %v", len(users))
+	}
+	if s.lastRead.Limit != 3 || s.lastRead.Offset != 2 {
+		t.Fatalf("expected the store to get limit 3 offset 2, got %+v", s.lastRead)
+	}
+}
+
+func TestReadBoundsStoreRead(t *testing.T) {
+	s := &boundedStore{Store: store.NewMemoryStore()}
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 10; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "dup"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var u user
+	if err := m.Read(Equals("name", "dup"), &u); err != ErrorMultipleRecords {
+		t.Fatalf("expected ErrorMultipleRecords, got %v", err)
+	}
+	if s.lastRead.Limit != 2 {
+		t.Fatalf("expected the store read bounded to 2 records, got %+v", s.lastRead)
+	}
+}
+
+func TestListEach(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i := 0; i < 150; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	err := m.ListEach(Equals("age", 30), func(raw []byte) error {
+		var u user
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 150 {
+		t.Fatalf("expected 150 records streamed, got %v", count)
+	}
+
+	// the callback error stops the iteration and is returned
+	stop := errors.New("stop")
+	count = 0
+	err = m.ListEach(Equals("age", 30), func(raw []byte) error {
+		count++
+		if count == 5 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("expected the callback error back, got %v", err)
+	}
+	if count != 5 {
+		t.Fatalf("expected iteration stopped at 5, got %v", count)
+	}
+}
+
+func TestAggregations(t *testing.T) {
+	type product struct {
+		ID       string  `json:"id"`
+		Category string  `json:"category"`
+		Price    float64 `json:"price"`
+	}
+	m := newTestModel(t, WithIndexes(ByEqualityOrderedBy("category", "price", false)))
+
+	// whole and fractional prices mixed, so the index edges only hold with
+	// the unified numeric key encoding
+	for i, price := range []float64{4, 1.5, 10} {
+		if err := m.Save(product{ID: fmt.Sprintf("%d", i), Category: "book", Price: price}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := Equals("category", "book")
+	if sum, err := m.Sum(q, "price"); err != nil || sum != 15.5 {
+		t.Fatalf("expected sum 15.5, got %v %v", sum, err)
+	}
+	if avg, err := m.Avg(q, "price"); err != nil || avg != 15.5/3 {
+		t.Fatalf("expected avg %v, got %v %v", 15.5/3, avg, err)
+	}
+	// min and max come off the index edges since the keys are price ordered
+	if min, err := m.Min(q, "price"); err != nil || min != 1.5 {
+		t.Fatalf("expected min 1.5, got %v %v", min, err)
+	}
+	if max, err := m.Max(q, "price"); err != nil || max != 10 {
+		t.Fatalf("expected max 10, got %v %v", max, err)
+	}
+
+	// empty results: zero sums, not found edges
+	empty := Equals("category", "toys")
+	if sum, err := m.Sum(empty, "price"); err != nil || sum != 0 {
+		t.Fatalf("expected sum 0, got %v %v", sum, err)
+	}
+	if avg, err := m.Avg(empty, "price"); err != nil || avg != 0 {
+		t.Fatalf("expected avg 0, got %v %v", avg, err)
+	}
+	if _, err := m.Min(empty, "price"); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+	if _, err := m.Max(empty, "price"); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name"), ByEquality("age")))
+
+	for i, u := range []user{
+		{Name: "bob", Age: 30},
+		{Name: "alice", Age: 25},
+		{Name: "bob", Age: 41},
+		{Name: "alice", Age: 30},
+	} {
+		u.ID = fmt.Sprintf("%d", i)
+		if err := m.Save(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := m.Distinct("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "alice" || names[1] != "bob" {
+		t.Fatalf("expected [alice bob], got %v", names)
+	}
+	ages, err := m.Distinct("age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ages) != 3 || ages[0] != int64(25) || ages[1] != int64(30) || ages[2] != int64(41) {
+		t.Fatalf("expected [25 30 41], got %v", ages)
+	}
+	if _, err := m.Distinct("email"); err == nil {
+		t.Fatal("expected an error for an unindexed field")
+	}
+}
+
+func TestDistinctDescending(t *testing.T) {
+	price := ByEquality("price")
+	price.Desc = true
+	m := newTestModel(t, WithIndexes(price))
+
+	type product struct {
+		ID    string  `json:"id"`
+		Price float64 `json:"price"`
+	}
+	// mixed whole and fractional values on a descending index, whose keys
+	// store the complement of both encoding halves
+	for i, p := range []float64{1, 2.5, 7} {
+		if err := m.Save(product{ID: fmt.Sprintf("%d", i), Price: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices, err := m.Distinct("price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 3 || prices[0] != int64(7) || prices[1] != float64(2.5) || prices[2] != int64(1) {
+		t.Fatalf("expected [7 2.5 1], got %v", prices)
+	}
+}
+
+func TestGroupByCount(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i, name := range []string{"bob", "alice", "bob", "carol", "bob"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := m.GroupByCount("name", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"alice": 1, "bob": 3, "carol": 1}
+	if len(groups) != len(want) {
+		t.Fatalf("expected %v, got %v", want, groups)
+	}
+	for name, count := range want {
+		if groups[name] != count {
+			t.Fatalf("expected %v, got %v", want, groups)
+		}
+	}
+	// a limit caps the groups, in index order
+	groups, err = m.GroupByCount("name", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups["alice"] != 1 || groups["bob"] != 3 {
+		t.Fatalf("expected the first two groups, got %v", groups)
+	}
+	if _, err := m.GroupByCount("email", 0); err == nil {
+		t.Fatal("expected an error for an unindexed field")
+	}
+
+	// a descending index decodes its complemented keys the same way
+	age := ByEquality("age")
+	age.Desc = true
+	dm := newTestModel(t, WithIndexes(age))
+	for i, a := range []int{30, 25, 30} {
+		if err := dm.Save(user{ID: fmt.Sprintf("%d", i), Name: "x", Age: a}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err = dm.GroupByCount("age", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups["30"] != 2 || groups["25"] != 1 {
+		t.Fatalf("expected {30:2 25:1}, got %v", groups)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name"), ByEquality("age")))
+	for i := 0; i < 3; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "alice", Age: 20 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected no records by name, got %v", users)
+	}
+	u := user{}
+	if err := m.Read(Equals("id", "0"), &u); err != ErrorNotFound {
+		t.Fatalf("expected not found by id, got %v", err)
+	}
+	keys, err := s.List(store.ListPrefix("default:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no keys left in the namespace, got %v", keys)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	s := store.NewMemoryStore()
+	// save with only an email index configured
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("age")))
+	for i, name := range []string{"alice", "bob"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name, Age: 30 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reopen over the same store with a name index instead
+	m = newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+	u := user{}
+	if err := m.Read(Equals("name", "alice"), &u); err != ErrorNotFound {
+		t.Fatalf("expected not found before reindex, got %v", err)
+	}
+	if err := m.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("name", "alice"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 30 {
+		t.Fatalf("expected alice's record, got %v", u)
+	}
+	// the removed age index's keys are swept out
+	keys, err := s.List(store.ListPrefix("default:byAge:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected stale age index keys to be removed, got %v", keys)
+	}
+}
+
+func TestVerifyRepair(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+	if err := m.Save(user{ID: "1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected a healthy model, got %v", found)
+	}
+
+	// drift the indexes by hand: drop bob's name key and plant a stray one
+	keys, err := s.List(store.ListPrefix("default:byName:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := ""
+	for _, key := range keys {
+		if strings.Contains(key, "bob") {
+			missing = key
+			if err := s.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	orphan := keys[0][:strings.LastIndex(keys[0], ":")] + ":9"
+	if err := s.Write(&store.Record{Key: orphan, Value: []byte(`{"id":"9"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 inconsistencies, got %v", found)
+	}
+	types := map[string]string{}
+	for _, inc := range found {
+		types[inc.Type] = inc.Key
+	}
+	if types[InconsistencyOrphan] != orphan {
+		t.Fatalf("expected orphan %v, got %v", orphan, found)
+	}
+	if types[InconsistencyMissing] != missing {
+		t.Fatalf("expected missing %v, got %v", missing, found)
+	}
+
+	if _, err := m.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	found, err = m.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected repair to restore consistency, got %v", found)
+	}
+	u := user{}
+	if err := m.Read(Equals("name", "bob"), &u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotEquals(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i, age := range []int{20, 30, 40, 30} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.List(NotEquals("age", 30), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", users)
+	}
+	if users[0].Age != 20 || users[1].Age != 40 {
+		t.Fatalf("expected the remaining ages in order, got %v", users)
+	}
+	// an unordered query finds no index to run against
+	q := NotEquals("age", 30)
+	q.Ordered = false
+	if err := m.List(q, &users); err == nil {
+		t.Fatal("expected an error without a matching ordered index")
+	}
+}
+
+func TestCaseInsensitiveIndex(t *testing.T) {
+	nameIndex := ByEquality("name")
+	nameIndex.CaseInsensitive = true
+	nameIndex.Unique = true
+	m := newTestModel(t, WithIndexes(nameIndex))
+
+	if err := m.Save(user{ID: "1", Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+	// a lookup by any casing finds the record, with its casing intact
+	u := user{}
+	if err := m.Read(Equals("name", "aLiCe"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Alice" {
+		t.Fatalf("expected the stored casing back, got %v", u.Name)
+	}
+	// uniqueness triggers across casings too
+	err := m.Save(user{ID: "2", Name: "ALICE"})
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("expected a unique violation across casings, got %v", err)
+	}
+}
+
+func TestKeyTransform(t *testing.T) {
+	nameIndex := ByEquality("name")
+	nameIndex.KeyTransform = strings.TrimSpace
+	m := newTestModel(t, WithIndexes(nameIndex))
+
+	if err := m.Save(user{ID: "1", Name: "  alice "}); err != nil {
+		t.Fatal(err)
+	}
+	u := user{}
+	if err := m.Read(Equals("name", "alice"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "  alice " {
+		t.Fatalf("expected the stored value untouched, got %q", u.Name)
+	}
+	// the transform applies to query values too
+	if err := m.Read(Equals("name", " alice  "), &u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONNumberBeyondInt64(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("n")))
+
+	// a 20 digit integer fits uint64 and must keep full precision
+	big := json.Number("18446744073709551615")
+	if err := m.Save(map[string]interface{}{"id": "1", "n": big}); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if err := m.Read(Equals("n", big), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["id"] != "1" {
+		t.Fatalf("expected the record back, got %v", got)
+	}
+
+	// past uint64 the value cannot be encoded without losing precision
+	err := m.Save(map[string]interface{}{"id": "2", "n": json.Number("99999999999999999999")})
+	if err == nil || !strings.Contains(err.Error(), "outside the encodable range") {
+		t.Fatalf("expected an explicit encoding error, got %v", err)
+	}
+}
+
+// scanLogger records log lines so tests can assert a scan was reported.
+type scanLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *scanLogger) Logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestAllowScanFallback(t *testing.T) {
+	logger := &scanLogger{}
+	m := newTestModel(t, WithAllowScan(), WithLogger(logger))
+
+	for i, name := range []string{"alice", "bob", "carol"} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: name, Age: 20 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no index on name exists, the scan filters in memory
+	users := []user{}
+	if err := m.List(Equals("name", "bob"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "bob" {
+		t.Fatalf("expected bob via scan, got %v", users)
+	}
+	users = []user{}
+	if err := m.List(GreaterThan("age", 20), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users via range scan, got %v", users)
+	}
+	u := user{}
+	if err := m.Read(Equals("name", "carol"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.lines) == 0 || !strings.Contains(logger.lines[0], "full scan") {
+		t.Fatalf("expected the scans to be logged, got %v", logger.lines)
+	}
+
+	// without AllowScan the same query still errors
+	m = newTestModel(t)
+	if err := m.List(Equals("name", "bob"), &users); err == nil {
+		t.Fatal("expected an error without AllowScan")
+	}
+}
+
+func TestQueryOrderOverride(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i, age := range []int{20, 40, 30} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "u", Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the index is ascending, the query asks for descending results
+	q := GreaterThan("age", 0)
+	q.Desc = true
+	users := []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{40, 30, 20}
+	if len(users) != len(want) {
+		t.Fatalf("expected %v users, got %v", len(want), users)
+	}
+	for i, u := range users {
+		if u.Age != want[i] {
+			t.Fatalf("expected descending ages %v, got %v", want, users)
+		}
+	}
+	// pagination applies after the reversal
+	q.Limit = 1
+	users = []user{}
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Age != 40 {
+		t.Fatalf("expected the highest age first, got %v", users)
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	u := user{}
+	if err := m.First(Equals("age", 10), &u); err != ErrorNotFound {
+		t.Fatalf("expected not found on an empty index, got %v", err)
+	}
+	for i, age := range []int{30, 10, 20} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "u", Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.First(GreaterThan("age", 0), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 10 {
+		t.Fatalf("expected the lowest age first, got %v", u)
+	}
+	if err := m.Last(GreaterThan("age", 0), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 30 {
+		t.Fatalf("expected the highest age last, got %v", u)
+	}
+}
+
+func TestReadByID(t *testing.T) {
+	m := newTestModel(t)
+
+	if err := m.Save(user{ID: "1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	u := user{}
+	if err := m.ReadByID("1", &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alice" {
+		t.Fatalf("expected alice, got %v", u)
+	}
+	if err := m.ReadByID("nosuch", &u); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
+
+func TestConfigurableIDField(t *testing.T) {
+	type account struct {
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	}
+	m := newTestModel(t, WithIDField("uuid"), WithIndexes(ByEquality("name")))
+
+	if err := m.Save(account{UUID: "abc-1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	a := account{}
+	if err := m.ReadByID("abc-1", &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "alice" {
+		t.Fatalf("expected alice, got %v", a)
+	}
+	if err := m.Read(Equals("uuid", "abc-1"), &a); err != nil {
+		t.Fatal(err)
+	}
+	// deleting by the configured id field removes the secondary keys too
+	if err := m.Delete(Equals("uuid", "abc-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("name", "alice"), &a); err != ErrorNotFound {
+		t.Fatalf("expected the name key gone, got %v", err)
+	}
+	// a record without the configured id field is rejected
+	if err := m.Save(map[string]interface{}{"name": "bob"}); err == nil {
+		t.Fatal("expected a save without the id field to fail")
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	m := newTestModel(t)
+
+	for i := 1; i <= 3; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: fmt.Sprintf("u%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []user{}
+	if err := m.ReadMany([]interface{}{"3", "nosuch", "1"}, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %v", users)
+	}
+	// input order is preserved, missing ids are skipped
+	if users[0].ID != "3" || users[1].ID != "1" {
+		t.Fatalf("expected users 3 and 1 in order, got %v", users)
+	}
+}
+
+func TestListWithTotal(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+
+	for i := 0; i < 5; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := Equals("name", "same")
+	q.Offset = 2
+	q.Limit = 2
+	users := []user{}
+	total, err := m.ListWithTotal(q, &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected a 2 record page, got %v", users)
+	}
+	if total != 5 {
+		t.Fatalf("expected total 5, got %v", total)
+	}
+}
+
+func TestQueryBuilders(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age")))
+
+	for i, age := range []int{10, 20, 30, 40} {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := GreaterThan("age", 0)
+	users := []user{}
+	if err := m.List(base.WithLimit(2).WithOffset(1).Reverse(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Age != 30 || users[1].Age != 20 {
+		t.Fatalf("expected ages 30, 20, got %v", users)
+	}
+	// the builders copy, the base query stays untouched
+	if base.Limit != 0 || base.Offset != 0 || base.Desc {
+		t.Fatalf("expected the base query unchanged, got %+v", base)
+	}
+}
+
+func TestIndexByReference(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexByReference(),
+		WithIndexes(ByEquality("name"), ByEquality("age")))
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// the secondary keys hold only the id key, not a record copy
+	keys, err := s.List(store.ListPrefix("default:byName:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 name key, got %v", keys)
+	}
+	recs, err := s.Read(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(recs[0].Value), "alice") {
+		t.Fatalf("expected a reference, got the full record %s", recs[0].Value)
+	}
+
+	// reads through the secondary index still return the body
+	u := user{}
+	if err := m.Read(Equals("name", "alice"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 30 {
+		t.Fatalf("expected the full record back, got %v", u)
+	}
+	users := []user{}
+	if err := m.List(GreaterThan("age", 0), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("expected alice via the age range, got %v", users)
+	}
+
+	// updates rewrite one body, and stale reference keys still get cleaned
+	if err := m.Save(user{ID: "1", Name: "alicia", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("name", "alice"), &u); err != ErrorNotFound {
+		t.Fatalf("expected the old name key gone, got %v", err)
+	}
+	if err := m.Read(Equals("name", "alicia"), &u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkList10k(b *testing.B) {
+	m, err := NewModel(WithIndexes(ByEquality("name")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "same", Age: i}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		users := []user{}
+		if err := m.List(Equals("name", "same"), &users); err != nil {
+			b.Fatal(err)
+		}
+		if len(users) != 10000 {
+			b.Fatalf("expected 10000 users, got %v", len(users))
+		}
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	m, err := NewModel(WithIndexes(ByEquality("name")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// countingStore wraps a store and counts reads, so cache tests can tell a
+// hit from a miss.
+type countingStore struct {
+	store.Store
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.Store.Read(key, opts...)
+}
+
+func (c *countingStore) readCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+func TestReadCache(t *testing.T) {
+	s := &countingStore{Store: store.NewMemoryStore()}
+	m := newTestModel(t, WithStore(s), WithReadCache(2))
+
+	if err := m.Save(user{ID: "1", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	u := user{}
+	if err := m.ReadByID("1", &u); err != nil {
+		t.Fatal(err)
+	}
+	after := s.readCount()
+	// the second read is a cache hit and never touches the store
+	if err := m.ReadByID("1", &u); err != nil {
+		t.Fatal(err)
+	}
+	if s.readCount() != after {
+		t.Fatalf("expected a cache hit, store reads went %v -> %v", after, s.readCount())
+	}
+	// an update evicts, the next read sees the new value
+	if err := m.Save(user{ID: "1", Name: "alicia"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReadByID("1", &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alicia" {
+		t.Fatalf("expected the updated record, got %v", u)
+	}
+	// a delete evicts too
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReadByID("1", &u); err != ErrorNotFound {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithCompression(), WithIndexes(ByEquality("name")))
+
+	big := user{ID: "1", Name: strings.Repeat("abcdefgh", 4096), Age: 30}
+	if err := m.Save(big); err != nil {
+		t.Fatal(err)
+	}
+	// the stored value carries the marker and is much smaller than the body
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		recs, err := s.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recs[0].Value[0] != compressMarker {
+			t.Fatalf("value under key '%v' is not compressed", key)
+		}
+		if len(recs[0].Value) > len(big.Name)/2 {
+			t.Fatalf("value under key '%v' did not shrink: %v bytes", key, len(recs[0].Value))
+		}
+	}
+
+	res := user{}
+	if err := m.Read(Equals("name", big.Name), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != big.Name || res.Age != 30 {
+		t.Fatal("compressed record did not round trip")
+	}
+
+	// records written before compression was enabled still read back
+	plain := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+	if err := plain.Save(user{ID: "2", Name: "jane", Age: 25}); err != nil {
+		t.Fatal(err)
+	}
+	res = user{}
+	if err := m.Read(Equals("name", "jane"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 25 {
+		t.Fatal("plain record did not read through a compressed model")
+	}
+}
+
+// gcmCipher is a minimal AES-GCM Cipher for tests, random nonce per value.
+type gcmCipher struct {
+	aead cipher.AEAD
+}
+
+func newGCMCipher(t *testing.T, key []byte) gcmCipher {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gcmCipher{aead: aead}
+}
+
+func (g gcmCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return g.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (g gcmCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < g.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ct := ciphertext[:g.aead.NonceSize()], ciphertext[g.aead.NonceSize():]
+	return g.aead.Open(nil, nonce, ct, nil)
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{42}, 32)
+	s := store.NewMemoryStore()
+	idx := ByEquality("name")
+	idx.Encrypted = true
+	m := newTestModel(t, WithStore(s),
+		WithEncryption(newGCMCipher(t, key), []byte("index-hmac-key")),
+		WithIndexes(idx))
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// neither the stored keys nor the stored values expose the field value
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if strings.Contains(k, "alice") {
+			t.Fatalf("key '%v' leaks the encrypted field value", k)
+		}
+		recs, err := s.Read(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recs[0].Value[0] != encryptMarker {
+			t.Fatalf("value under key '%v' is not encrypted", k)
+		}
+		if bytes.Contains(recs[0].Value, []byte("alice")) {
+			t.Fatalf("value under key '%v' leaks plaintext", k)
+		}
+	}
+
+	// equality lookups keep working through the HMAC digests
+	res := user{}
+	if err := m.Read(Equals("name", "alice"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 30 {
+		t.Fatal("encrypted record did not round trip")
+	}
+
+	// ordered queries over the encrypted field are rejected
+	users := []user{}
+	if err := m.List(GreaterThan("name", "a"), &users); err == nil {
+		t.Fatal("expected range query on encrypted field to fail")
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+	acme := WithTenant(context.Background(), "acme")
+	globex := WithTenant(context.Background(), "globex")
+
+	if err := m.SaveContext(acme, user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveContext(globex, user{ID: "1", Name: "alice", Age: 99}); err != nil {
+		t.Fatal(err)
+	}
+
+	// each tenant reads only its own record under the shared id
+	res := user{}
+	if err := m.ReadContext(acme, Equals("name", "alice"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 30 {
+		t.Fatalf("acme read the wrong record: %+v", res)
+	}
+	if err := m.ReadContext(globex, Equals("name", "alice"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 99 {
+		t.Fatalf("globex read the wrong record: %+v", res)
+	}
+	// the base namespace sees neither
+	if err := m.Read(Equals("name", "alice"), &res); err != ErrorNotFound {
+		t.Fatalf("expected not found in the base namespace, got %v", err)
+	}
+
+	// a delete in one tenant leaves the other untouched
+	if err := m.DeleteContext(acme, Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReadContext(acme, Equals("name", "alice"), &res); err != ErrorNotFound {
+		t.Fatalf("expected not found after tenant delete, got %v", err)
+	}
+	users := []user{}
+	if err := m.ListContext(globex, Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("expected globex to keep its record, got %v", len(users))
+	}
+}
+
+func TestModelFromStruct(t *testing.T) {
+	type account struct {
+		UUID  string `json:"uuid" model:"id"`
+		Email string `json:"email" model:"unique"`
+		Name  string `json:"name" model:"index"`
+		Score int    `json:"score" model:"index,order=desc"`
+	}
+	m, err := ModelFromStruct(store.NewMemoryStore(), "accounts", account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(account{UUID: "a", Email: "a@example.com", Name: "alice", Score: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(account{UUID: "b", Email: "b@example.com", Name: "bob", Score: 20}); err != nil {
+		t.Fatal(err)
+	}
+	// the id tag nominated uuid as the primary key
+	res := account{}
+	if err := m.Read(Equals("uuid", "a"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "alice" {
+		t.Fatalf("expected alice, got %+v", res)
+	}
+	// the unique tag is enforced
+	if err := m.Save(account{UUID: "c", Email: "a@example.com", Name: "carol"}); err == nil {
+		t.Fatal("expected the unique email index to reject a duplicate")
+	}
+	// the desc tag orders the score index descending
+	accounts := []account{}
+	if err := m.List(GreaterThan("score", 0).Reverse(), &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[0].Score != 20 {
+		t.Fatalf("expected descending scores, got %+v", accounts)
+	}
+
+	// two id tags conflict
+	type twoIDs struct {
+		A string `json:"a" model:"id"`
+		B string `json:"b" model:"id"`
+	}
+	if _, err := ModelFromStruct(store.NewMemoryStore(), "broken", twoIDs{}); err == nil {
+		t.Fatal("expected two id tags to be rejected")
+	}
+}
+
+func TestValidation(t *testing.T) {
+	type patient struct {
+		ID    string `json:"id"`
+		Name  string `json:"name" validate:"required"`
+		Age   int    `json:"age" validate:"min=0,max=120"`
+		Email string `json:"email" validate:"email"`
+	}
+	m := newTestModel(t, WithValidation())
+
+	// a valid record passes
+	if err := m.Save(patient{ID: "1", Name: "alice", Age: 30, Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// required, min and max failures come back as one ValidationError
+	err := m.Save(patient{ID: "2", Age: 150})
+	verr := &ValidationError{}
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	if verr.Fields["name"] == "" || verr.Fields["age"] == "" {
+		t.Fatalf("expected name and age failures, got %v", verr.Fields)
+	}
+	if err := m.Save(patient{ID: "3", Name: "bob", Age: -1}); err == nil {
+		t.Fatal("expected the min bound to reject a negative age")
+	}
+	if err := m.Save(patient{ID: "4", Name: "carol", Email: "not-an-email"}); err == nil {
+		t.Fatal("expected the email check to reject a malformed address")
+	}
+	// nothing invalid was written
+	count, err := m.Count(Equals("id", nil))
+	if err == nil && count > 1 {
+		t.Fatalf("invalid records were stored: %v", count)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	type ticket struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Owner  string `json:"owner"`
+	}
+	m := newTestModel(t,
+		WithDefaults(map[string]interface{}{"status": "new", "owner": "system"}),
+		WithIndexes(ByEquality("status")))
+
+	// absent fields pick up the defaults, stored and indexed
+	if err := m.Save(ticket{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	res := ticket{}
+	if err := m.Read(Equals("status", "new"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "new" || res.Owner != "system" {
+		t.Fatalf("defaults not applied: %+v", res)
+	}
+
+	// an explicit value overrides the default
+	if err := m.Save(ticket{ID: "2", Status: "open", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	res = ticket{}
+	if err := m.Read(Equals("status", "open"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Owner != "alice" {
+		t.Fatalf("explicit value was overridden: %+v", res)
+	}
+}
+
+// recordingMetrics counts observations per op for the metrics test.
+type recordingMetrics struct {
+	mu      sync.Mutex
+	ops     map[string]int
+	records map[string]int
+	timed   bool
+}
+
+func (r *recordingMetrics) ObserveOp(op string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ops == nil {
+		r.ops = map[string]int{}
+	}
+	r.ops[op]++
+	if d > 0 {
+		r.timed = true
+	}
+}
+
+func (r *recordingMetrics) ObserveRecords(op string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.records == nil {
+		r.records = map[string]int{}
+	}
+	r.records[op] += n
+}
+
+func TestMetrics(t *testing.T) {
+	rec := &recordingMetrics{}
+	m := newTestModel(t, WithMetrics(rec), WithIndexes(ByEquality("name"), ByEquality("age")))
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "bob", Age: 40}); err != nil {
+		t.Fatal(err)
+	}
+	res := user{}
+	if err := m.Read(Equals("name", "alice"), &res); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(GreaterThan("age", 0), &users); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(Equals("id", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.ops["save"] != 2 || rec.ops["read"] != 1 || rec.ops["list"] != 1 || rec.ops["delete"] != 1 {
+		t.Fatalf("unexpected op counts: %v", rec.ops)
+	}
+	if rec.records["list"] != 2 {
+		t.Fatalf("expected a list result set of 2, got %v", rec.records)
+	}
+	if !rec.timed {
+		t.Fatal("expected non-zero durations")
+	}
+}
+
+// recordingTracer collects finished spans for the tracing test.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{tracer: r, name: name, attrs: map[string]interface{}{}}
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return ctx, span
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended = true
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	m := newTestModel(t, WithTracer(tracer), WithIndexes(ByEquality("name")))
+
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(Equals("name", "alice"), &users); err != nil {
+		t.Fatal(err)
+	}
+	res := user{}
+	if err := m.Read(Equals("name", "nobody"), &res); err != ErrorNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) != 3 {
+		t.Fatalf("expected 3 spans, got %v", len(tracer.spans))
+	}
+	save, list, read := tracer.spans[0], tracer.spans[1], tracer.spans[2]
+	if save.name != "model.Save" || save.attrs["key"] == nil || !save.ended {
+		t.Fatalf("unexpected save span: %+v", save)
+	}
+	if list.name != "model.List" || list.attrs["index"] != "byName" || list.attrs["records"] != 1 {
+		t.Fatalf("unexpected list span: %+v", list)
+	}
+	if prefix, _ := list.attrs["prefix"].(string); !strings.Contains(prefix, "byName") {
+		t.Fatalf("expected the scanned prefix on the span, got %v", list.attrs["prefix"])
+	}
+	if read.err != ErrorNotFound {
+		t.Fatalf("expected the read span to record the error, got %v", read.err)
+	}
+}
+
+func TestNoMatchingIndexError(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+	users := []user{}
+	err := m.List(Equals("age", 30), &users)
+	missing := &ErrNoMatchingIndex{}
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected ErrNoMatchingIndex from List, got %v", err)
+	}
+	if missing.QueryType != "eq" || missing.FieldName != "age" {
+		t.Fatalf("unexpected error detail: %+v", missing)
+	}
+	res := user{}
+	if err := m.Read(Equals("age", 30), &res); !errors.As(err, &missing) {
+		t.Fatalf("expected ErrNoMatchingIndex from Read, got %v", err)
+	}
+}
+
+// BaseEntity is exported so the json decoder can allocate pointer embeds of
+// it in the embedded field test.
+type BaseEntity struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func TestEmbeddedStructFields(t *testing.T) {
+	type article struct {
+		BaseEntity
+		Title string `json:"title"`
+	}
+	m := newTestModel(t, WithIndexes(ByEquality("title")))
+
+	// the promoted id field satisfies the id requirement and the indexed
+	// field resolves through the reflection fast path
+	if err := m.Save(article{BaseEntity: BaseEntity{ID: "a1"}, Title: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	res := article{}
+	if err := m.Read(Equals("title", "hello"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "a1" {
+		t.Fatalf("expected the promoted id back, got %+v", res)
+	}
+
+	// pointer embeds resolve too, and a nil embed falls back cleanly
+	type ptrArticle struct {
+		*BaseEntity
+		Title string `json:"title"`
+	}
+	pm := newTestModel(t, WithIndexes(ByEquality("title")))
+	if err := pm.Save(ptrArticle{BaseEntity: &BaseEntity{ID: "p1"}, Title: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	pres := ptrArticle{}
+	if err := pm.Read(Equals("title", "world"), &pres); err != nil {
+		t.Fatal(err)
+	}
+	if pres.ID != "p1" {
+		t.Fatalf("expected the pointer-embedded id back, got %+v", pres)
+	}
+}
+
+func TestInsertOnly(t *testing.T) {
+	cs := &countingStore{Store: store.NewMemoryStore()}
+	m := newTestModel(t, WithStore(cs), WithInsertOnly(), WithIndexes(ByEquality("name")))
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	cs.mu.Lock()
+	reads := cs.reads
+	cs.mu.Unlock()
+	if reads != 0 {
+		t.Fatalf("expected no old entry read on an insert-only save, got %v reads", reads)
+	}
+	res := user{}
+	if err := m.Read(Equals("name", "alice"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 30 {
+		t.Fatalf("insert did not round trip: %+v", res)
+	}
+}
+
+func BenchmarkSaveInsertOnly(b *testing.B) {
+	m, err := NewModel(WithInsertOnly(), WithIndexes(ByEquality("name")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.Save(user{ID: fmt.Sprintf("%d", i), Name: "alice", Age: 30}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// blippingStore fails every call with a transient error until failures runs
+// out, for the retry test.
+type blippingStore struct {
+	store.Store
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+var errBlip = errors.New("connection reset")
+
+func (b *blippingStore) trip() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		return errBlip
+	}
+	return nil
+}
+
+func (b *blippingStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	if err := b.trip(); err != nil {
+		return nil, err
+	}
+	return b.Store.Read(key, opts...)
+}
+
+func (b *blippingStore) Write(r *store.Record, opts ...store.WriteOption) error {
+	if err := b.trip(); err != nil {
+		return err
+	}
+	return b.Store.Write(r, opts...)
+}
+
+func TestRetry(t *testing.T) {
+	bs := &blippingStore{Store: store.NewMemoryStore(), failures: 2}
+	m := newTestModel(t, WithStore(bs), WithRetry(Retry{
+		Attempts:    3,
+		Delay:       time.Millisecond,
+		Multiplier:  2,
+		IsRetryable: func(err error) bool { return errors.Is(err, errBlip) },
+	}))
+
+	// two blips, then success within the three attempts
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	res := user{}
+	if err := m.Read(Equals("id", "1"), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// more blips than attempts gives up with the underlying error
+	bs.mu.Lock()
+	bs.failures = 5
+	bs.mu.Unlock()
+	if err := m.Save(user{ID: "2", Name: "bob", Age: 40}); !errors.Is(err, errBlip) {
+		t.Fatalf("expected the transient error after exhausting retries, got %v", err)
+	}
+
+	// non-retryable errors fail on the first attempt
+	bs.mu.Lock()
+	bs.failures = 1
+	bs.calls = 0
+	bs.mu.Unlock()
+	nm := newTestModel(t, WithStore(bs), WithRetry(Retry{
+		Attempts:    3,
+		Delay:       time.Millisecond,
+		IsRetryable: func(err error) bool { return false },
+	}))
+	if err := nm.Save(user{ID: "3", Name: "carol", Age: 50}); !errors.Is(err, errBlip) {
+		t.Fatalf("expected the error through untouched, got %v", err)
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.calls != 1 {
+		t.Fatalf("expected a single attempt for a non-retryable error, got %v", bs.calls)
+	}
+}
+
+func TestIndexKeyName(t *testing.T) {
+	type doc struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Upper string `json:"Title"`
+	}
+	// "title" and "Title" both derive the "byTitle" prefix; explicit key
+	// names keep the two indexes apart
+	lower := ByEquality("title")
+	lower.KeyName = "byTitleLower"
+	upper := ByEquality("Title")
+	upper.KeyName = "byTitleUpper"
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(lower, upper))
+
+	if err := m.Save(doc{ID: "1", Title: "go", Upper: "rust"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, k := range keys {
+		names[strings.Split(k, ":")[1]] = true
+	}
+	if !names["byTitleLower"] || !names["byTitleUpper"] {
+		t.Fatalf("expected both explicit index names in the keys, got %v", names)
+	}
+
+	// queries against either field resolve through their own index
+	res := doc{}
+	if err := m.Read(Equals("title", "go"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("Title", "rust"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Title != "go" {
+		t.Fatalf("cross read between the case-colliding fields: %+v", res)
+	}
+}
+
+func TestIndexNameCollision(t *testing.T) {
+	// the derived names fold only the first rune, so these stay apart
+	if indexName(ByEquality("userName")) == indexName(ByEquality("username")) {
+		t.Fatal("expected distinct derived names for userName and username")
+	}
+
+	// fields differing only in their leading rune still collide and are
+	// rejected up front instead of silently sharing keys
+	if _, err := NewModel(WithIndexes(ByEquality("title"), ByEquality("Title"))); err == nil {
+		t.Fatal("expected the colliding index names to be rejected")
+	}
+
+	// an explicit KeyName resolves the collision
+	upper := ByEquality("Title")
+	upper.KeyName = "byTitleUpper"
+	if _, err := NewModel(WithIndexes(ByEquality("title"), upper)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+	created, err := m.Upsert(user{ID: "1", Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected the first upsert to report created")
+	}
+	created, err = m.Upsert(user{ID: "1", Name: "alice", Age: 31})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Fatal("expected the second upsert to report an update")
+	}
+	res := user{}
+	if err := m.Read(Equals("id", "1"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 31 {
+		t.Fatalf("expected the update to stick, got %+v", res)
+	}
+}
+
+func TestCreateAlreadyExists(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+	if _, err := m.Create(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(user{ID: "1", Name: "intruder", Age: 99}); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	// the stored record is untouched by the refused create
+	res := user{}
+	if err := m.Read(Equals("id", "1"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "alice" || res.Age != 30 {
+		t.Fatalf("refused create modified the record: %+v", res)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	s := store.NewMemoryStore()
+	m := newTestModel(t, WithStore(s), WithIndexes(ByEquality("name")))
+
+	if err := m.Replace(user{ID: "1", Name: "alice", Age: 30}); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound for a missing id, got %v", err)
+	}
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Replace(user{ID: "1", Name: "alicia", Age: 31}); err != nil {
+		t.Fatal(err)
+	}
+	res := user{}
+	if err := m.Read(Equals("name", "alicia"), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Age != 31 {
+		t.Fatalf("replace did not stick: %+v", res)
+	}
+	// the stale secondary key of the old name is gone
+	if err := m.Read(Equals("name", "alice"), &res); err != ErrorNotFound {
+		t.Fatalf("expected the old name key to be cleaned up, got %v", err)
+	}
+}
+
+func TestSmallNumericTypes(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("n")))
+	for i, v := range []interface{}{
+		int8(-5), int16(-300), int32(70000), uint8(200), uint16(50000),
+	} {
+		id := fmt.Sprintf("%v", i)
+		if err := m.Save(map[string]interface{}{"id": id, "n": v}); err != nil {
+			t.Fatalf("save of %T failed: %v", v, err)
+		}
+		// the small types widen to the 64-bit encodings, so int queries match
+		res := map[string]interface{}{}
+		if err := m.Read(Equals("n", v), &res); err != nil {
+			t.Fatalf("read of %T failed: %v", v, err)
+		}
+		if fmt.Sprintf("%v", res["id"]) != id {
+			t.Fatalf("read of %T returned the wrong record: %v", v, res)
+		}
+	}
+
+	// a float32 field saved through the reflection path matches queries made
+	// with the same float32, despite the widening
+	type reading struct {
+		ID    string  `json:"id"`
+		Value float32 `json:"value"`
+	}
+	fm := newTestModel(t, WithIndexes(ByEquality("value")))
+	if err := fm.Save(reading{ID: "r1", Value: 3.14}); err != nil {
+		t.Fatal(err)
+	}
+	// re-save so the old entry decode has to produce the same key too
+	if err := fm.Save(reading{ID: "r1", Value: 3.14}); err != nil {
+		t.Fatal(err)
+	}
+	res := reading{}
+	if err := fm.Read(Equals("value", float32(3.14)), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "r1" {
+		t.Fatalf("float32 read returned the wrong record: %+v", res)
+	}
+}
+
+// status is a Stringer enum for the textual index key test.
+type status int
+
+func (s status) String() string {
+	switch s {
+	case 1:
+		return "active"
+	case 2:
+		return "archived"
+	}
+	return "unknown"
+}
+
+// sku is a TextMarshaler id type for the textual index key test.
+type sku struct {
+	Region string
+	Number int
+}
+
+func (s sku) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v-%04d", s.Region, s.Number)), nil
+}
+
+func (s *sku) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "%2s-%04d", &s.Region, &s.Number)
+	return err
+}
+
+func TestTextualIndexValues(t *testing.T) {
+	// an int backed enum in a map keys on its underlying kind instead of
+	// erroring on the named type, matching the json form of stored records
+	m := newTestModel(t, WithIndexes(ByEquality("status")))
+	if err := m.Save(map[string]interface{}{"id": "1", "status": status(1)}); err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]interface{}{}
+	if err := m.Read(Equals("status", status(1)), &res); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", res["id"]) != "1" {
+		t.Fatalf("stringer read returned the wrong record: %v", res)
+	}
+
+	// a TextMarshaler field keys on its marshaled text, which is also its
+	// json form, so queries and stored records line up
+	type product struct {
+		ID   string `json:"id"`
+		Code sku    `json:"code"`
+	}
+	pm := newTestModel(t, WithIndexes(ByEquality("code")))
+	if err := pm.Save(product{ID: "p1", Code: sku{Region: "eu", Number: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	pres := product{}
+	if err := pm.Read(Equals("code", sku{Region: "eu", Number: 7}), &pres); err != nil {
+		t.Fatal(err)
+	}
+	if pres.ID != "p1" {
+		t.Fatalf("text marshaler read returned the wrong record: %+v", pres)
+	}
+}
+
+func TestTx(t *testing.T) {
+	idx := ByEquality("name")
+	idx.Unique = true
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("txusers"), WithIndexes(idx))
+	if err := m.Save(user{ID: "3", Name: "Carol", Age: 33}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := m.Tx()
+	tx.Save(user{ID: "1", Name: "Alice", Age: 21})
+	tx.Save(user{ID: "2", Name: "Bob", Age: 25})
+	tx.Delete(Equals("id", "3"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	users := []user{}
+	if err := m.List(Equals("id", "1"), &users); err != nil || len(users) != 1 {
+		t.Fatalf("expected the first save to apply, got %v %v", users, err)
+	}
+	if err := m.Read(Equals("id", "3"), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected the delete to apply, got %v", err)
+	}
+	// a committed transaction is empty and reusable
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	idx := ByEquality("name")
+	idx.Unique = true
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("txroll"), WithIndexes(idx))
+	if err := m.Save(user{ID: "b", Name: "Bob", Age: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "c", Name: "Carol", Age: 33}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third operation violates the unique name index, so the new save,
+	// the overwrite and the delete before it must all roll back
+	tx := m.Tx()
+	tx.Save(user{ID: "a", Name: "Alice", Age: 21})
+	tx.Save(user{ID: "b", Name: "Bobby", Age: 41})
+	tx.Delete(Equals("id", "c"))
+	tx.Save(user{ID: "d", Name: "Alice", Age: 50})
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected the unique violation to fail the commit")
+	}
+	if err := m.Read(Equals("id", "a"), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected the new record to be rolled back, got %v", err)
+	}
+	bob := user{}
+	if err := m.Read(Equals("id", "b"), &bob); err != nil {
+		t.Fatal(err)
+	}
+	if bob.Name != "Bob" || bob.Age != 40 {
+		t.Fatalf("expected the overwrite to be rolled back, got %+v", bob)
+	}
+	carol := user{}
+	if err := m.Read(Equals("id", "c"), &carol); err != nil || carol.Name != "Carol" {
+		t.Fatalf("expected the delete to be rolled back, got %+v %v", carol, err)
+	}
+	if err := m.Read(Equals("id", "d"), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected the failing record to be absent, got %v", err)
+	}
+	// the old name key must be back too
+	if err := m.Read(Equals("name", "Bob"), &user{}); err != nil {
+		t.Fatalf("expected the old index key to be restored, got %v", err)
+	}
+}
+
+func TestEqualityMatchIgnoresOrder(t *testing.T) {
+	unordered := ByEquality("name")
+	unordered.Ordered = false
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("unorderedeq"), WithIndexes(unordered))
+	if err := m.Save(user{ID: "1", Name: "Alice", Age: 21}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default-order query must still be served by the unordered index
+	alice := user{}
+	if err := m.Read(Equals("name", "Alice"), &alice); err != nil {
+		t.Fatal(err)
+	}
+	if alice.ID != "1" {
+		t.Fatalf("expected the record, got %+v", alice)
+	}
+
+	// and an unordered query by an ordered index, here the id index
+	q := Equals("id", "1")
+	q.Ordered = false
+	got := user{}
+	if err := m.Read(q, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Alice" {
+		t.Fatalf("expected the record, got %+v", got)
+	}
+}
+
+func TestDebugKeys(t *testing.T) {
+	tags := ByEquality("tags")
+	tags.MultiValue = true
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("debugkeys"), WithIndexes(ByEquality("name"), tags))
+
+	type post struct {
+		ID   string   `json:"id"`
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	keys, err := m.DebugKeys(post{ID: "1", Name: "intro", Tags: []string{"go", "model"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("expected keys for the id, name and two tag entries, got %v", keys)
+	}
+	for _, name := range []string{"byId", "byName", "byTags[0]", "byTags[1]"} {
+		key, ok := keys[name]
+		if !ok {
+			t.Fatalf("expected a key for index '%v', got %v", name, keys)
+		}
+		if !strings.HasPrefix(key, "debugkeys:") {
+			t.Fatalf("expected a namespaced key for '%v', got %v", name, key)
+		}
+	}
+	// the id key must be exactly the one a save writes
+	if key, err := m.KeyForRecord(ByEquality("name"), post{ID: "1", Name: "intro"}); err != nil || keys["byName"] != key {
+		t.Fatalf("expected '%v' to match the save key '%v' (%v)", keys["byName"], key, err)
+	}
+	// the store is never touched and type errors surface as errors
+	if _, err := m.DebugKeys(map[string]interface{}{"id": "2", "name": []int{1}}); err == nil {
+		t.Fatal("expected an unencodable field to error")
+	}
+	if err := m.Read(Equals("id", "1"), &post{}); err != ErrorNotFound {
+		t.Fatalf("expected the store to be untouched, got %v", err)
+	}
+}
+
+func TestListAll(t *testing.T) {
+	age := ByEquality("age")
+	age.Ordered = true
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("listall"), WithIndexes(age))
+	for _, u := range []user{
+		{ID: "1", Name: "Carol", Age: 33},
+		{ID: "2", Name: "Alice", Age: 21},
+		{ID: "3", Name: "Bob", Age: 25},
+	} {
+		if err := m.Save(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []user{}
+	if err := m.List(ListAll("age"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Age != 21 || users[1].Age != 25 || users[2].Age != 33 {
+		t.Fatalf("expected all records in age order, got %+v", users)
+	}
+	users = nil
+	if err := m.List(ListAll("age").Reverse(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Age != 33 {
+		t.Fatalf("expected the reverse age order, got %+v", users)
+	}
+	// the id index lists everything too
+	users = nil
+	if err := m.List(ListAll("id"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("expected every record, got %+v", users)
+	}
+}
+
+func TestReverseReads(t *testing.T) {
+	age := ByEquality("age")
+	age.Desc = true
+	m := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("reverse"), WithIndexes(age), WithReverseReads())
+	for _, u := range []user{
+		{ID: "1", Name: "Carol", Age: 33},
+		{ID: "2", Name: "Alice", Age: 21},
+		{ID: "3", Name: "Bob", Age: 25},
+	} {
+		if err := m.Save(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the keys land in natural ascending form despite the Desc flag: they
+	// match what a plain ascending index produces, not the inverted encoding
+	plain := newTestModel(t, WithStore(store.NewMemoryStore()), WithNamespace("reverse"), WithIndexes(ByEquality("age")))
+	keys, err := m.DebugKeys(user{ID: "1", Name: "Carol", Age: 33})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKeys, err := plain.DebugKeys(user{ID: "1", Name: "Carol", Age: 33})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["byAge"] != plainKeys["byAge"] {
+		t.Fatalf("expected the ascending key form, got '%v' want '%v'", keys["byAge"], plainKeys["byAge"])
+	}
+
+	// both directions come back correctly ordered
+	users := []user{}
+	if err := m.List(ListAll("age"), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Age != 21 || users[2].Age != 33 {
+		t.Fatalf("expected the ascending age order, got %+v", users)
+	}
+	users = nil
+	if err := m.List(ListAll("age").Reverse(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Age != 33 || users[2].Age != 21 {
+		t.Fatalf("expected the descending age order, got %+v", users)
+	}
+
+	// descending pagination pushes down to the store
+	users = nil
+	q := ListAll("age").Reverse()
+	q.Limit = 1
+	q.Offset = 1
+	if err := m.List(q, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Age != 25 {
+		t.Fatalf("expected the middle record, got %+v", users)
+	}
+
+	// First at the reversed edge reads backward through the store
+	oldest := user{}
+	if err := m.First(ListAll("age").Reverse(), &oldest); err != nil {
+		t.Fatal(err)
+	}
+	if oldest.Age != 33 {
+		t.Fatalf("expected the oldest, got %+v", oldest)
+	}
+
+	// range queries run off the same ascending keys
+	users = nil
+	if err := m.List(GreaterThan("age", 22), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Age != 25 || users[1].Age != 33 {
+		t.Fatalf("expected the records above 22 in order, got %+v", users)
+	}
+
+	// a store without the capability is refused up front
+	if _, err := NewModel(WithStore(&countingStore{Store: store.NewMemoryStore()}), WithReverseReads()); err == nil {
+		t.Fatal("expected a store without reverse iteration to be rejected")
+	}
+}
+
+func TestLargeUintKeys(t *testing.T) {
+	type counter struct {
+		ID  string `json:"id"`
+		Val uint64 `json:"val"`
+	}
+	valIdx := ByEquality("val")
+	valIdx.Unique = true
+	m := newTestModel(t, WithIndexes(valIdx))
+
+	// a value past int64 must not collide with the signed value 2^63 below
+	// it: 9223372036854775809 and 1 used to produce the same key
+	if err := m.Save(counter{ID: "small", Val: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(counter{ID: "big", Val: 9223372036854775809}); err != nil {
+		t.Fatalf("expected no false unique violation, got %v", err)
+	}
+	if err := m.Save(counter{ID: "five", Val: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(counter{ID: "bigfive", Val: 9223372036854775813}); err != nil {
+		t.Fatalf("expected no false unique violation against 5, got %v", err)
+	}
+
+	counters := []counter{}
+	if err := m.List(Equals("val", uint64(1)), &counters); err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters[0].ID != "small" {
+		t.Fatalf("expected only the small record, got %+v", counters)
+	}
+	counters = nil
+	if err := m.List(Equals("val", uint64(9223372036854775809)), &counters); err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters[0].ID != "big" {
+		t.Fatalf("expected only the big record, got %+v", counters)
+	}
+
+	// values past int64 sort after every signed-range value
+	counters = nil
+	if err := m.List(GreaterThan("val", 0), &counters); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"small", "five", "big", "bigfive"}
+	if len(counters) != len(want) {
+		t.Fatalf("expected %v records, got %+v", len(want), counters)
+	}
+	for i, c := range counters {
+		if c.ID != want[i] {
+			t.Fatalf("expected the order %v, got %+v", want, counters)
+		}
+	}
+}
+
+func TestReadNonEqualityQueries(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("age"), ByEquality("name")))
+	if err := m.Save(user{ID: "1", Name: "alice", Age: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "2", Name: "jonas", Age: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a strict range must not return its own boundary record
+	u := user{}
+	if err := m.Read(GreaterThan("age", 5), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "2" {
+		t.Fatalf("expected the record above the boundary, got %+v", u)
+	}
+	if err := m.Read(GreaterThan("age", 8), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound above the top record, got %v", err)
+	}
+
+	// the excluded record must not come back
+	u = user{}
+	if err := m.Read(NotEquals("age", 8), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "1" {
+		t.Fatalf("expected the other record, got %+v", u)
+	}
+
+	// prefix terms are shorter than the padded stored keys
+	u = user{}
+	if err := m.Read(StartsWith("name", "jo"), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "jonas" {
+		t.Fatalf("expected jonas, got %+v", u)
+	}
+
+	// several matches stay an error, like for equality reads
+	if err := m.Save(user{ID: "3", Name: "zoe", Age: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(GreaterThan("age", 5), &user{}); err != ErrorMultipleRecords {
+		t.Fatalf("expected ErrorMultipleRecords, got %v", err)
+	}
+}
+
+func TestDeleteNonEqualityQueries(t *testing.T) {
+	m := newTestModel(t, WithIndexes(ByEquality("name")))
+	if err := m.Save(user{ID: "a", Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(user{ID: "b", Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the boundary id names the range, not the record to remove
+	if err := m.Delete(GreaterThan("id", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(Equals("id", "b"), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected the record above the boundary to be deleted, got %v", err)
+	}
+	u := user{}
+	if err := m.Read(Equals("id", "a"), &u); err != nil {
+		t.Fatalf("expected the boundary record to survive, got %v", err)
+	}
+	// its secondary keys went with it
+	if err := m.Read(Equals("name", "bob"), &user{}); err != ErrorNotFound {
+		t.Fatalf("expected the name key to be deleted too, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// Query is a declarative description of the records wanted from a List or
+// Read. Queries only run against a matching index.
+type Query struct {
+	// Type of query, eg. equality
+	Type string
+	// FieldName is the name of the field to filter on
+	FieldName string
+	// Value to compare the field against. For range queries this is the
+	// lower bound.
+	Value interface{}
+	// To is the upper bound for queries with two bounds, eg. Between
+	To interface{}
+	// Offset is the number of matching records to skip
+	Offset int64
+	// Limit is the maximum number of records to return
+	Limit int64
+	// Cursor resumes a paginated listing right after the record it was
+	// returned for. Only used by ListPage.
+	Cursor string
+	// IncludeDeleted includes soft deleted records in the results. Only
+	// meaningful on models with soft deletes enabled.
+	IncludeDeleted bool
+	// Desc returns the results in descending order. When it differs from
+	// the physical direction of the index serving the query, the results
+	// are reversed in memory after the read.
+	Desc bool
+	// Ordered must match the Ordered flag of the index being queried, except
+	// for equality queries with a fully specified value, which match an index
+	// of either order.
+	Ordered bool
+}
+
+// Equals returns an equality query for the given field, ie. "field == value".
+func Equals(fieldName string, value interface{}) Query {
+	return Query{
+		Type:      queryTypeEq,
+		FieldName: fieldName,
+		Value:     value,
+		Ordered:   true,
+	}
+}
+
+// ListAll returns a query listing every record in the index on the given
+// field, in the index's natural order — the idiomatic "list everything
+// ordered by X". The nil value keeps the scan prefix to the index name
+// alone, so no field value is encoded; combine with Reverse for the other
+// direction.
+func ListAll(fieldName string) Query {
+	return Query{
+		Type:      queryTypeEq,
+		FieldName: fieldName,
+		Ordered:   true,
+	}
+}
+
+// EqualsPairs returns an equality query over several fields at once, for use
+// with a composite index built by ByEqualities over the same fields. The
+// pairs are keyed deterministically so the declaration order does not matter.
+func EqualsPairs(pairs map[string]interface{}) Query {
+	names := make([]string, 0, len(pairs))
+	for name := range pairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return Query{
+		Type:      queryTypeEq,
+		FieldName: strings.Join(names, ","),
+		Value:     pairs,
+		Ordered:   true,
+	}
+}
+
+// NotEquals returns an exclusion query for records whose field value differs
+// from value. It requires an ordered index on the field: conceptually it is
+// the two range scans below and above the excluded value, which the ordered
+// key encoding serves as one prefix scan that skips the excluded key.
+func NotEquals(fieldName string, value interface{}) Query {
+	return Query{
+		Type:      queryTypeNotEq,
+		FieldName: fieldName,
+		Value:     value,
+		Ordered:   true,
+	}
+}
+
+// StartsWith returns a prefix query for records whose string field value
+// begins with prefix, eg. for autocompletion. It requires an ordered string
+// index on the field.
+func StartsWith(fieldName, prefix string) Query {
+	return Query{
+		Type:      queryTypeStartsWith,
+		FieldName: fieldName,
+		Value:     prefix,
+		Ordered:   true,
+	}
+}
+
+// GreaterThan returns a range query for records whose field value is
+// strictly greater than value. It requires an ordered index on the field.
+func GreaterThan(fieldName string, value interface{}) Query {
+	return Query{
+		Type:      queryTypeGt,
+		FieldName: fieldName,
+		Value:     value,
+		Ordered:   true,
+	}
+}
+
+// LessThan returns a range query for records whose field value is strictly
+// less than value. It requires an ordered index on the field.
+func LessThan(fieldName string, value interface{}) Query {
+	return Query{
+		Type:      queryTypeLt,
+		FieldName: fieldName,
+		Value:     value,
+		Ordered:   true,
+	}
+}
+
+// Between returns a range query for records whose field value falls within
+// [low, high] inclusive. The bounds are encoded with the same logic as the
+// saved values, so int, int64 and whole float64 bounds all share the padded
+// integer encoding, while fractional floats use the float encoding. Mixed
+// numeric types therefore compare correctly as long as they encode to the
+// same width.
+func Between(fieldName string, low, high interface{}) Query {
+	return Query{
+		Type:      queryTypeBetween,
+		FieldName: fieldName,
+		Value:     low,
+		To:        high,
+		Ordered:   true,
+	}
+}
+
+// WithLimit returns a copy of the query returning at most limit records.
+// The value receiver means the original query is untouched, so queries
+// compose: Equals("age", 30).WithLimit(10).WithOffset(20).Reverse().
+func (q Query) WithLimit(limit int64) Query {
+	q.Limit = limit
+	return q
+}
+
+// WithOffset returns a copy of the query skipping the first offset records.
+func (q Query) WithOffset(offset int64) Query {
+	q.Offset = offset
+	return q
+}
+
+// Reverse returns a copy of the query requesting the opposite order.
+func (q Query) Reverse() Query {
+	q.Desc = !q.Desc
+	return q
+}
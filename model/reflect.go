@@ -0,0 +1,204 @@
+package model
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structFieldCache caches the json tag to field index mapping per struct
+// type so repeated saves do not re-walk the type.
+var structFieldCache sync.Map // reflect.Type -> map[string][]int
+
+func structFieldIndexes(t reflect.Type) map[string][]int {
+	if cached, ok := structFieldCache.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+	fields := map[string][]int{}
+	// embedded structs promote their fields like the json encoder does, so
+	// the reflection path resolves the same names the decode path sees. The
+	// named fields go in first: an outer field shadows a promoted one.
+	promoted := map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := f.Name
+		tag, tagged := f.Tag.Lookup("json")
+		if tagged {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		if f.Anonymous && !tagged {
+			inner := f.Type
+			for inner.Kind() == reflect.Ptr {
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct {
+				for innerName, innerIndex := range structFieldIndexes(inner) {
+					promoted[innerName] = append(append([]int{}, f.Index...), innerIndex...)
+				}
+				continue
+			}
+		}
+		fields[name] = f.Index
+	}
+	for name, index := range promoted {
+		if _, ok := fields[name]; !ok {
+			fields[name] = index
+		}
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+// compiledPath is the struct field index chain for one dotted field path on
+// a concrete type, one index per segment. A nil chain marks a path the type
+// cannot serve, so the failure is cached too.
+type compiledPath [][]int
+
+// compileFieldPaths resolves each dotted field path against a struct type
+// once, through the json tag mapping, so saves of the same type walk plain
+// field indexes instead of re-resolving tags per call.
+func compileFieldPaths(t reflect.Type, paths []string) map[string]compiledPath {
+	compiled := make(map[string]compiledPath, len(paths))
+	for _, path := range paths {
+		segments := strings.Split(path, ".")
+		chain := make(compiledPath, 0, len(segments))
+		cur := t
+		for i, segment := range segments {
+			for cur.Kind() == reflect.Ptr {
+				cur = cur.Elem()
+			}
+			if cur.Kind() != reflect.Struct {
+				chain = nil
+				break
+			}
+			index, ok := structFieldIndexes(cur)[segment]
+			if !ok {
+				chain = nil
+				break
+			}
+			chain = append(chain, index)
+			if i < len(segments)-1 {
+				cur = cur.FieldByIndex(index).Type
+			}
+		}
+		compiled[path] = chain
+	}
+	return compiled
+}
+
+// fieldValues reads the values for the given field paths straight off a
+// struct, sparing Save the json round trip it would otherwise need just to
+// see the indexed fields. The path resolution is compiled and cached per
+// type on the first save, keyed on the model so differently indexed models
+// do not share entries. It returns false when v is not a struct or one of
+// the values has a kind the key encoders do not understand, in which case
+// the caller falls back to decoding the marshaled record.
+func (d *db) fieldValues(v interface{}, paths []string) (map[string]interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, false
+	}
+	var compiled map[string]compiledPath
+	if cached, ok := d.fieldPaths.Load(rv.Type()); ok {
+		compiled = cached.(map[string]compiledPath)
+	} else {
+		compiled = compileFieldPaths(rv.Type(), paths)
+		d.fieldPaths.Store(rv.Type(), compiled)
+	}
+	out := map[string]interface{}{}
+	for _, path := range paths {
+		chain, ok := compiled[path]
+		if !ok || chain == nil {
+			return nil, false
+		}
+		value, ok := walkFieldPath(rv, chain)
+		if !ok {
+			return nil, false
+		}
+		setPathValue(out, path, value)
+	}
+	return out, true
+}
+
+// walkFieldPath follows a compiled field index chain down a struct value and
+// converts the field at the end to the types the key encoders expect.
+func walkFieldPath(rv reflect.Value, chain compiledPath) (interface{}, bool) {
+	for i, index := range chain {
+		for rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return nil, false
+			}
+			rv = rv.Elem()
+		}
+		// promoted fields have a multi element index; a nil pointer embed
+		// along the way means the field is unreachable
+		fv, err := rv.FieldByIndexErr(index)
+		if err != nil {
+			return nil, false
+		}
+		rv = fv
+		if i < len(chain)-1 {
+			continue
+		}
+		if t, ok := rv.Interface().(time.Time); ok {
+			return t, true
+		}
+		switch rv.Kind() {
+		case reflect.String:
+			return rv.String(), true
+		case reflect.Bool:
+			return rv.Bool(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int(), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u := rv.Uint()
+			if u <= math.MaxInt64 {
+				// encodes the same as the json decode of the old entry
+				return int64(u), true
+			}
+			return u, true
+		case reflect.Float64:
+			return rv.Float(), true
+		case reflect.Float32:
+			// a plain widening drifts away from what a json round trip of
+			// the float32 produces; the key encoder widens through the
+			// shortest decimal representation, so hand it the float32
+			return float32(rv.Float()), true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// setPathValue writes a value into nested maps following a dotted path, so
+// the result looks like the json decode the fallback produces.
+func setPathValue(m map[string]interface{}, path string, value interface{}) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		child, ok := m[segment].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			m[segment] = child
+		}
+		m = child
+	}
+	m[segments[len(segments)-1]] = value
+}
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"time"
+
+	"github.com/micro/website/model/store"
+)
+
+// Retry configures automatic retries of transient store errors, eg. network
+// blips against a remote store. Which errors count as transient is decided
+// by the injected classifier, so the model stays free of store internals.
+type Retry struct {
+	// Attempts is the maximum number of tries per store call, including
+	// the first one
+	Attempts int
+	// Delay is the wait before the first retry
+	Delay time.Duration
+	// Multiplier scales the delay after each failed attempt, eg. 2 for an
+	// exponential backoff. Values below 1 keep the delay constant.
+	Multiplier float64
+	// IsRetryable classifies an error as transient. Only errors it returns
+	// true for are retried; with no classifier nothing is.
+	IsRetryable func(error) bool
+}
+
+// retryStore wraps a store and retries its calls per the policy. Wrapping at
+// the store boundary covers every operation — saves, reads, lists, deletes
+// and the maintenance helpers — without each path growing a retry loop. The
+// store interface carries no context, so the backoff sleeps are bounded only
+// by the policy, not by a caller's deadline.
+type retryStore struct {
+	store.Store
+	retry Retry
+}
+
+// do runs one store call, retrying transient failures with backoff.
+func (r *retryStore) do(op func() error) error {
+	delay := r.retry.Delay
+	var err error
+	for attempt := 0; attempt < r.retry.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			if r.retry.Multiplier > 1 {
+				delay = time.Duration(float64(delay) * r.retry.Multiplier)
+			}
+		}
+		if err = op(); err == nil {
+			return nil
+		}
+		if err == store.ErrNotFound || r.retry.IsRetryable == nil || !r.retry.IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *retryStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	var recs []*store.Record
+	err := r.do(func() error {
+		var err error
+		recs, err = r.Store.Read(key, opts...)
+		return err
+	})
+	return recs, err
+}
+
+func (r *retryStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	return r.do(func() error {
+		return r.Store.Write(rec, opts...)
+	})
+}
+
+func (r *retryStore) Delete(key string, opts ...store.DeleteOption) error {
+	return r.do(func() error {
+		return r.Store.Delete(key, opts...)
+	})
+}
+
+func (r *retryStore) List(opts ...store.ListOption) ([]string, error) {
+	var keys []string
+	err := r.do(func() error {
+		var err error
+		keys, err = r.Store.List(opts...)
+		return err
+	})
+	return keys, err
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryStore returns a Store backed by an in memory map. Reads over a
+// prefix return records in ascending key order, or descending with the
+// ReadDescending option. It is intended for local development and tests.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		values: map[string]*memoryRecord{},
+	}
+}
+
+type memoryStore struct {
+	sync.RWMutex
+	values map[string]*memoryRecord
+}
+
+type memoryRecord struct {
+	value   []byte
+	expires time.Time
+}
+
+func (m *memoryStore) get(key string) (*Record, bool) {
+	v, ok := m.values[key]
+	if !ok {
+		return nil, false
+	}
+	if !v.expires.IsZero() && time.Now().After(v.expires) {
+		return nil, false
+	}
+	rec := &Record{
+		Key:   key,
+		Value: make([]byte, len(v.value)),
+	}
+	copy(rec.Value, v.value)
+	if !v.expires.IsZero() {
+		rec.Expiry = time.Until(v.expires)
+	}
+	return rec, true
+}
+
+func (m *memoryStore) Read(key string, opts ...ReadOption) ([]*Record, error) {
+	options := ReadOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	if !options.Prefix {
+		rec, ok := m.get(key)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return []*Record{rec}, nil
+	}
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		if strings.HasPrefix(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if options.Descending {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	records := []*Record{}
+	for i, k := range keys {
+		if options.Offset > 0 && uint(i) < options.Offset {
+			continue
+		}
+		rec, ok := m.get(k)
+		if !ok {
+			continue
+		}
+		records = append(records, rec)
+		if options.Limit > 0 && uint(len(records)) >= options.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// ReverseReads marks the descending read capability, see ReverseReader.
+func (m *memoryStore) ReverseReads() bool {
+	return true
+}
+
+func (m *memoryStore) Write(r *Record, opts ...WriteOption) error {
+	options := WriteOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	rec := &memoryRecord{
+		value: make([]byte, len(r.Value)),
+	}
+	copy(rec.value, r.Value)
+
+	if r.Expiry > 0 {
+		rec.expires = time.Now().Add(r.Expiry)
+	}
+	if options.TTL > 0 {
+		rec.expires = time.Now().Add(options.TTL)
+	}
+	if !options.Expiry.IsZero() {
+		rec.expires = options.Expiry
+	}
+
+	m.values[r.Key] = rec
+	return nil
+}
+
+func (m *memoryStore) Delete(key string, opts ...DeleteOption) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memoryStore) List(opts ...ListOption) ([]string, error) {
+	options := ListOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	keys := make([]string, 0, len(m.values))
+	for k, v := range m.values {
+		if options.Prefix != "" && !strings.HasPrefix(k, options.Prefix) {
+			continue
+		}
+		if !v.expires.IsZero() && time.Now().After(v.expires) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if options.Offset > 0 {
+		if uint(len(keys)) <= options.Offset {
+			return []string{}, nil
+		}
+		keys = keys[options.Offset:]
+	}
+	if options.Limit > 0 && uint(len(keys)) > options.Limit {
+		keys = keys[:options.Limit]
+	}
+	return keys, nil
+}
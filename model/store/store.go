@@ -0,0 +1,158 @@
+// Package store is a minimal key value storage abstraction used by the model
+// package. It mirrors the shape of the micro store interface so a model can
+// be backed by any conforming implementation.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a read finds no record for the given key.
+	ErrNotFound = errors.New("not found")
+)
+
+// Record is an item stored or retrieved from a Store.
+type Record struct {
+	// Key is the unique identifier of the record
+	Key string
+	// Value is the raw contents of the record
+	Value []byte
+	// Expiry is an optional time to live. Zero means the record never expires.
+	Expiry time.Duration
+}
+
+// Store is a data storage interface.
+type Store interface {
+	// Read takes a single key and optional ReadOptions. It returns matching
+	// records or an error.
+	Read(key string, opts ...ReadOption) ([]*Record, error)
+	// Write writes a record to the store.
+	Write(r *Record, opts ...WriteOption) error
+	// Delete removes the record with the corresponding key from the store.
+	Delete(key string, opts ...DeleteOption) error
+	// List returns any keys that match, or an empty list with no error if
+	// none matched.
+	List(opts ...ListOption) ([]string, error)
+}
+
+// ReverseReader is an optional capability of a Store: implementations that
+// can iterate a prefix in descending key order honor the ReadDescending
+// option. Callers must check the capability before relying on the option —
+// a store without it silently ignores the flag.
+type ReverseReader interface {
+	// ReverseReads reports whether descending prefix reads are supported.
+	ReverseReads() bool
+}
+
+// ReadOptions configure an individual Read operation.
+type ReadOptions struct {
+	// Prefix returns all records that are prefixed with key
+	Prefix bool
+	// Limit limits the number of returned records
+	Limit uint
+	// Offset when read many records
+	Offset uint
+	// Descending returns prefix reads in reverse key order. Only honored by
+	// stores implementing ReverseReader; Limit and Offset apply to the
+	// reversed order.
+	Descending bool
+}
+
+// ReadOption sets values in ReadOptions.
+type ReadOption func(r *ReadOptions)
+
+// ReadPrefix returns all records that are prefixed with key.
+func ReadPrefix() ReadOption {
+	return func(r *ReadOptions) {
+		r.Prefix = true
+	}
+}
+
+// ReadLimit limits the number of records read to l.
+func ReadLimit(l uint) ReadOption {
+	return func(r *ReadOptions) {
+		r.Limit = l
+	}
+}
+
+// ReadOffset skips the first o records read.
+func ReadOffset(o uint) ReadOption {
+	return func(r *ReadOptions) {
+		r.Offset = o
+	}
+}
+
+// ReadDescending returns prefix reads in reverse key order, on stores
+// implementing ReverseReader.
+func ReadDescending() ReadOption {
+	return func(r *ReadOptions) {
+		r.Descending = true
+	}
+}
+
+// WriteOptions configure an individual Write operation.
+type WriteOptions struct {
+	// Expiry is the time the record expires
+	Expiry time.Time
+	// TTL is the time until the record expires
+	TTL time.Duration
+}
+
+// WriteOption sets values in WriteOptions.
+type WriteOption func(w *WriteOptions)
+
+// WriteExpiry is the time the record expires.
+func WriteExpiry(t time.Time) WriteOption {
+	return func(w *WriteOptions) {
+		w.Expiry = t
+	}
+}
+
+// WriteTTL is the time the record expires relative to now.
+func WriteTTL(d time.Duration) WriteOption {
+	return func(w *WriteOptions) {
+		w.TTL = d
+	}
+}
+
+// DeleteOptions configure an individual Delete operation.
+type DeleteOptions struct{}
+
+// DeleteOption sets values in DeleteOptions.
+type DeleteOption func(d *DeleteOptions)
+
+// ListOptions configure an individual List operation.
+type ListOptions struct {
+	// Prefix returns all keys that are prefixed with this
+	Prefix string
+	// Limit limits the number of returned keys
+	Limit uint
+	// Offset when listing many keys
+	Offset uint
+}
+
+// ListOption sets values in ListOptions.
+type ListOption func(l *ListOptions)
+
+// ListPrefix returns all keys that are prefixed with p.
+func ListPrefix(p string) ListOption {
+	return func(l *ListOptions) {
+		l.Prefix = p
+	}
+}
+
+// ListLimit limits the number of keys returned to l.
+func ListLimit(l uint) ListOption {
+	return func(lo *ListOptions) {
+		lo.Limit = l
+	}
+}
+
+// ListOffset skips the first o keys listed.
+func ListOffset(o uint) ListOption {
+	return func(l *ListOptions) {
+		l.Offset = o
+	}
+}
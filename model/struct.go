@@ -0,0 +1,84 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/micro/website/model/store"
+)
+
+// ModelFromStruct builds a model whose indexes are declared as `model` struct
+// tags on the sample type, so the index definitions live next to the fields
+// they cover instead of being repeated at construction:
+//
+//	type User struct {
+//		UUID  string `json:"uuid" model:"id"`
+//		Email string `json:"email" model:"unique"`
+//		Name  string `json:"name" model:"index"`
+//		Score int    `json:"score" model:"index,order=desc"`
+//	}
+//
+// `model:"index"` adds an equality index on the field, `model:"unique"` makes
+// it unique, `model:"order=desc"` stores the keys descending and `model:"id"`
+// nominates the field as the primary key. Field names follow the json tags,
+// the same mapping Save uses. Any further options are applied after the tag
+// derived ones, so eg. an explicit WithIndexes overrides the tags entirely.
+func ModelFromStruct(s store.Store, namespace string, sample interface{}, opts ...Option) (Model, error) {
+	t := reflect.TypeOf(sample)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ModelFromStruct requires a struct sample, got %T", sample)
+	}
+	indexes := []Index{}
+	idField := ""
+	// walk the fields in declaration order so the derived index set is
+	// deterministic
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		value, ok := f.Tag.Lookup("model")
+		if !ok {
+			continue
+		}
+		name := f.Name
+		if jsonTag, ok := f.Tag.Lookup("json"); ok {
+			if tagName := strings.Split(jsonTag, ",")[0]; tagName != "" && tagName != "-" {
+				name = tagName
+			}
+		}
+		idx := ByEquality(name)
+		indexed := false
+		for _, part := range strings.Split(value, ",") {
+			switch part {
+			case "id":
+				if idField != "" {
+					return nil, fmt.Errorf("both '%v' and '%v' are tagged as the id field", idField, name)
+				}
+				idField = name
+			case "index":
+				indexed = true
+			case "unique":
+				indexed = true
+				idx.Unique = true
+			case "order=asc":
+			case "order=desc":
+				idx.Desc = true
+			default:
+				return nil, fmt.Errorf("field '%v' has an unknown model tag '%v'", name, part)
+			}
+		}
+		if indexed {
+			indexes = append(indexes, idx)
+		}
+	}
+	derived := []Option{WithStore(s), WithNamespace(namespace), WithIndexes(indexes...)}
+	if idField != "" {
+		derived = append(derived, WithIDField(idField))
+	}
+	return NewModel(append(derived, opts...)...)
+}
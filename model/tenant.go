@@ -0,0 +1,32 @@
+package model
+
+import "context"
+
+// tenantKey is the context key carrying a per-operation tenant id.
+type tenantKey struct{}
+
+// WithTenant returns a context scoping the operations run with it to one
+// tenant. Keys are written and read as "tenant:namespace:...", so one model
+// instance serves every tenant and their data never cross-reads. Pass the
+// returned context to the Context variants of Save, Read, List and Delete;
+// operations without a tenant on their context, including the maintenance
+// and aggregation helpers, work on the base namespace.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant id set by WithTenant, if any.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// namespace returns the key namespace for one operation: the configured
+// namespace, prefixed by the tenant carried on the context when there is
+// one. The tenant is escaped so it cannot shift the key boundaries.
+func (d *db) namespace(ctx context.Context) string {
+	if tenant, ok := TenantFromContext(ctx); ok && tenant != "" {
+		return escapeKeyPart(tenant) + ":" + d.options.Namespace
+	}
+	return d.options.Namespace
+}
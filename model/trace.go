@@ -0,0 +1,56 @@
+package model
+
+import "context"
+
+// Tracer starts spans around the model's operations, so slow queries show up
+// in distributed traces. The interface mirrors the OpenTelemetry tracer
+// shape without this package importing it; an adapter is a few lines. The
+// returned context carries the span, and the operation annotates it with the
+// index it used, the key prefix it scanned and the record count before
+// ending it, so a span tells which physical read was slow.
+type Tracer interface {
+	// Start opens a span named after the operation, eg. "model.List"
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced operation, annotated and ended by the model.
+type Span interface {
+	// SetAttribute records a key/value on the span, eg. the index name
+	SetAttribute(key string, value interface{})
+	// RecordError marks the span as failed with the given error
+	RecordError(err error)
+	// End closes the span
+	End()
+}
+
+// noopTracer is the default Tracer, tracing nothing.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// spanKey is the context key carrying the active span down to the internal
+// read and write paths, which annotate it.
+type spanKey struct{}
+
+// startSpan opens a span for an operation and stores it on the context so
+// the layers below can annotate it.
+func (d *db) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := d.options.Tracer.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the active span of the operation, if any.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tx is a transaction-scoped writer: a unit of work buffering heterogeneous
+// saves and deletes that are applied together on Commit. The store has no
+// native transactions, so the flush is a best-effort ordered apply — when an
+// operation fails, the ones already applied are rolled back by restoring the
+// record state read just before the flush, mirroring the rollback a single
+// Save does for its own keys. Concurrent writers can still interleave with
+// the flush; the grouping protects against partial application, not against
+// races.
+type Tx struct {
+	d   *db
+	ops []txOp
+}
+
+// txOp is one buffered operation: a record to save, or a query to delete by.
+type txOp struct {
+	save   interface{}
+	delete *Query
+}
+
+// Tx returns a new empty transaction on the model. Operations buffer until
+// Commit and a Tx is not safe for concurrent use.
+func (d *db) Tx() *Tx {
+	return &Tx{d: d}
+}
+
+// Save buffers a record to be saved on Commit.
+func (t *Tx) Save(v interface{}) *Tx {
+	t.ops = append(t.ops, txOp{save: v})
+	return t
+}
+
+// Delete buffers a delete of the record matching the query on Commit.
+func (t *Tx) Delete(query Query) *Tx {
+	t.ops = append(t.ops, txOp{delete: &query})
+	return t
+}
+
+// Commit applies the buffered operations in order. On a failure the already
+// applied operations are rolled back in reverse before the error is
+// returned, so the unit of work either fully applies or leaves the records
+// as they were. A successful commit empties the transaction for reuse.
+func (t *Tx) Commit() error {
+	// snapshot of one record's state before its operation, for rollback
+	type undo struct {
+		id   interface{}
+		prev map[string]interface{}
+	}
+	undos := []undo{}
+	rollback := func(err error) error {
+		for i := len(undos) - 1; i >= 0; i-- {
+			u := undos[i]
+			if u.prev == nil {
+				// the record did not exist before; remove what the flush wrote
+				if derr := t.d.Delete(Equals(t.d.options.IDField, u.id)); derr != nil {
+					return fmt.Errorf("rolling back '%v' after %v: %v", u.id, err, derr)
+				}
+				continue
+			}
+			if serr := t.d.Save(u.prev); serr != nil {
+				return fmt.Errorf("rolling back '%v' after %v: %v", u.id, err, serr)
+			}
+		}
+		return err
+	}
+	for _, op := range t.ops {
+		var id interface{}
+		if op.save != nil {
+			js, err := t.d.options.Codec.Marshal(op.save)
+			if err != nil {
+				return rollback(err)
+			}
+			m := map[string]interface{}{}
+			if err := t.d.decode(js, &m); err != nil {
+				return rollback(err)
+			}
+			var ok bool
+			if id, ok = m[t.d.options.IDField]; !ok {
+				return rollback(fmt.Errorf("a value with a non empty '%v' field is required", t.d.options.IDField))
+			}
+		} else {
+			id = op.delete.Value
+		}
+		// the pre-flush state of the record, nil when it does not exist
+		var prev map[string]interface{}
+		snapshot := map[string]interface{}{}
+		err := t.d.readContext(context.Background(), Equals(t.d.options.IDField, id), &snapshot)
+		if err == nil {
+			prev = snapshot
+		} else if err != ErrorNotFound {
+			return rollback(err)
+		}
+		if op.save != nil {
+			err = t.d.Save(op.save)
+		} else {
+			err = t.d.Delete(*op.delete)
+		}
+		if err != nil {
+			return rollback(err)
+		}
+		undos = append(undos, undo{id: id, prev: prev})
+	}
+	t.ops = nil
+	return nil
+}
@@ -0,0 +1,39 @@
+package model
+
+// TypedModel wraps a Model with a concrete record type, so callers get
+// compile time safety instead of threading untyped pointers through every
+// call. It delegates to the wrapped model for all of the actual work.
+type TypedModel[T any] struct {
+	model Model
+}
+
+// NewTypedModel wraps an existing model with a record type.
+func NewTypedModel[T any](m Model) *TypedModel[T] {
+	return &TypedModel[T]{model: m}
+}
+
+// Save stores the record and writes all of its index keys.
+func (t *TypedModel[T]) Save(v T, opts ...SaveOption) error {
+	return t.model.Save(v, opts...)
+}
+
+// Read returns exactly one record matching the query.
+func (t *TypedModel[T]) Read(query Query) (T, error) {
+	var result T
+	err := t.model.Read(query, &result)
+	return result, err
+}
+
+// List returns all records matching the query.
+func (t *TypedModel[T]) List(query Query) ([]T, error) {
+	var results []T
+	if err := t.model.List(query, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Delete removes the record matching the query.
+func (t *TypedModel[T]) Delete(query Query) error {
+	return t.model.Delete(query)
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValidationError reports the fields of a record that failed validation on
+// Save. Callers can type assert on it to render per-field messages.
+type ValidationError struct {
+	// Fields maps each offending field name to the reason it failed
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%v: %v", name, e.Fields[name])
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// validationRule is the compiled form of one field's `validate` tag.
+type validationRule struct {
+	fieldIndex []int
+	required   bool
+	min        *float64
+	max        *float64
+	email      bool
+}
+
+// validationCache caches the compiled rules per struct type, so the tag
+// parsing happens once and validated saves stay cheap.
+var validationCache sync.Map // reflect.Type -> map[string]validationRule
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// compileValidationRules parses the `validate` struct tags of a type into
+// rules keyed by the json field name.
+func compileValidationRules(t reflect.Type) (map[string]validationRule, error) {
+	if cached, ok := validationCache.Load(t); ok {
+		return cached.(map[string]validationRule), nil
+	}
+	rules := map[string]validationRule{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag, ok := f.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+		name := f.Name
+		if jsonTag, ok := f.Tag.Lookup("json"); ok {
+			if tagName := strings.Split(jsonTag, ",")[0]; tagName != "" && tagName != "-" {
+				name = tagName
+			}
+		}
+		rule := validationRule{fieldIndex: f.Index}
+		for _, part := range strings.Split(tag, ",") {
+			switch {
+			case part == "required":
+				rule.required = true
+			case part == "email":
+				rule.email = true
+			case strings.HasPrefix(part, "min="):
+				n, err := strconv.ParseFloat(part[len("min="):], 64)
+				if err != nil {
+					return nil, fmt.Errorf("field '%v' has an invalid min bound '%v'", name, part)
+				}
+				rule.min = &n
+			case strings.HasPrefix(part, "max="):
+				n, err := strconv.ParseFloat(part[len("max="):], 64)
+				if err != nil {
+					return nil, fmt.Errorf("field '%v' has an invalid max bound '%v'", name, part)
+				}
+				rule.max = &n
+			default:
+				return nil, fmt.Errorf("field '%v' has an unknown validate tag '%v'", name, part)
+			}
+		}
+		rules[name] = rule
+	}
+	validationCache.Store(t, rules)
+	return rules, nil
+}
+
+// validateStruct checks a record against its `validate` tags and returns a
+// ValidationError listing every offending field. Non-struct records, eg.
+// maps, carry no tags and pass.
+func validateStruct(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	rules, err := compileValidationRules(rv.Type())
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	failed := map[string]string{}
+	for name, rule := range rules {
+		fv := rv.FieldByIndex(rule.fieldIndex)
+		for fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				fv = reflect.Value{}
+				break
+			}
+			fv = fv.Elem()
+		}
+		if rule.required && (!fv.IsValid() || fv.IsZero()) {
+			failed[name] = "is required"
+			continue
+		}
+		if !fv.IsValid() {
+			continue
+		}
+		if rule.min != nil || rule.max != nil {
+			if n, ok := numericValue(fv); ok {
+				if rule.min != nil && n < *rule.min {
+					failed[name] = fmt.Sprintf("must be at least %v", *rule.min)
+					continue
+				}
+				if rule.max != nil && n > *rule.max {
+					failed[name] = fmt.Sprintf("must be at most %v", *rule.max)
+					continue
+				}
+			}
+		}
+		if rule.email && fv.Kind() == reflect.String && fv.String() != "" {
+			if !emailPattern.MatchString(fv.String()) {
+				failed[name] = "is not a valid email address"
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &ValidationError{Fields: failed}
+	}
+	return nil
+}
+
+// numericValue widens a numeric field to float64 for bound checks.
+func numericValue(rv reflect.Value) (float64, bool) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"context"
+	"strings"
+)
+
+// Event types emitted by Watch.
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Event describes one change to a record matching a watched query. Delete
+// events carry no value, the type is the marker.
+type Event struct {
+	// Type of change, one of EventCreate, EventUpdate, EventDelete
+	Type string
+	// ID of the changed record
+	ID string
+	// Value is the record after the change, as a decoded map. Nil on delete.
+	Value map[string]interface{}
+}
+
+// watchBuffer is the per watcher channel buffer. A watcher that falls this
+// far behind starts losing events rather than blocking writers.
+const watchBuffer = 64
+
+type watcher struct {
+	idx    Index
+	prefix string
+	ch     chan Event
+}
+
+// Watch streams change events for records matching the query. Matching is
+// done against the index key prefix the query would read, so it needs an
+// index just like List does. The returned stop function unsubscribes and
+// closes the channel. The store is not consulted — events fan out in-process
+// from the save and delete paths — so changes made through another process
+// are not seen.
+func (d *db) Watch(query Query) (<-chan Event, func(), error) {
+	for _, idx := range d.allIndexes() {
+		if !indexMatchesQuery(idx, query) {
+			continue
+		}
+		prefix, err := d.queryToListKey(context.Background(), idx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		w := &watcher{idx: idx, prefix: prefix, ch: make(chan Event, watchBuffer)}
+		d.watchersMu.Lock()
+		d.watchers = append(d.watchers, w)
+		d.watchersMu.Unlock()
+		stop := func() {
+			d.watchersMu.Lock()
+			for i, existing := range d.watchers {
+				if existing == w {
+					d.watchers = append(d.watchers[:i], d.watchers[i+1:]...)
+					close(w.ch)
+					break
+				}
+			}
+			d.watchersMu.Unlock()
+		}
+		return w.ch, stop, nil
+	}
+	return nil, nil, queryIndexError(query)
+}
+
+// hasWatchers reports whether any watcher is subscribed.
+func (d *db) hasWatchers() bool {
+	d.watchersMu.Lock()
+	defer d.watchersMu.Unlock()
+	return len(d.watchers) > 0
+}
+
+// notify fans an event out to every watcher whose index prefix covers the
+// record. Watchers that cannot keep up lose the event rather than blocking
+// the write path.
+func (d *db) notify(eventType, id string, m map[string]interface{}) {
+	d.watchersMu.Lock()
+	defer d.watchersMu.Unlock()
+	for _, w := range d.watchers {
+		value, err := indexFieldValue(w.idx, m)
+		if err != nil {
+			continue
+		}
+		key, err := d.indexToKey(context.Background(), w.idx, id, value, true)
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		ev := Event{Type: eventType, ID: id}
+		if eventType != EventDelete {
+			ev.Value = m
+		}
+		select {
+		case w.ch <- ev:
+		default:
+		}
+	}
+}